@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	adminToken string
+	// adminAllow are the networks admin endpoints may be called from, from
+	// ISUCON5_ADMIN_ALLOW.
+	adminAllow []*net.IPNet
+)
+
+// parseAllowlist reads comma separated CIDRs; a bare address allows just
+// that host.
+func parseAllowlist(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// adminAllowed checks the address the connection came from. Forwarded
+// headers are not trusted, so a reverse proxy in front has to be allowed
+// itself.
+func adminAllowed(r *http.Request) bool {
+	ip := net.ParseIP(remoteIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, n := range adminAllow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminAuthorized checks the "Authorization: Bearer <token>" header against
+// ISUCON5_ADMIN_TOKEN. Admin endpoints are disabled while the token is unset.
+func adminAuthorized(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(adminToken)) == 1
+}
+
+// requireAdmin lets through callers from an allowed network with the admin
+// token, and writes an audit log line for every call, refused or not.
+func requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := "allowed"
+		switch {
+		case !adminAllowed(r):
+			result = "address_denied"
+		case !adminAuthorized(r):
+			result = "token_denied"
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		if result == "allowed" {
+			h.ServeHTTP(sw, r)
+		} else {
+			writeError(sw, r, true, ErrPermissionDenied)
+		}
+		logEvent("audit",
+			"request_id", requestID(r),
+			"remote_addr", r.RemoteAddr,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"result", result,
+			"status", sw.status,
+		)
+	})
+}
+
+func adminHandler(fn appHandler) http.Handler {
+	return requireAdmin(apiHandler(fn))
+}
+
+// AttachAdmin mounts the operational endpoints: the admin API, /initialize,
+// /metrics and pprof. They are all behind requireAdmin.
+func AttachAdmin(router *mux.Router) {
+	a := router.PathPrefix("/admin").Subrouter()
+	a.Handle("/users/{account_name}/sessions", adminHandler(GetAdminUserSessions)).Methods("GET")
+	a.Handle("/users/{account_name}/sessions", adminHandler(DeleteAdminUserSessions)).Methods("DELETE")
+	a.Handle("/sessions/{session_key}", adminHandler(DeleteAdminSession)).Methods("DELETE")
+	a.Handle("/friend_cache", adminHandler(GetAdminFriendCache)).Methods("GET")
+
+	router.Handle("/initialize", adminHandler(GetInitialize)).Methods("GET", "POST")
+	router.Handle("/metrics", requireAdmin(http.HandlerFunc(GetMetrics))).Methods("GET")
+	AttachProfiler(router)
+}
+
+func GetAdminUserSessions(w http.ResponseWriter, r *http.Request) error {
+	user, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	recs, err := store.Backend.ListByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, recs)
+}
+
+func DeleteAdminUserSessions(w http.ResponseWriter, r *http.Request) error {
+	user, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := store.Backend.DeleteByUser(user.ID); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func DeleteAdminSession(w http.ResponseWriter, r *http.Request) error {
+	if err := store.Backend.Delete(mux.Vars(r)["session_key"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func GetAdminFriendCache(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, friendCache.Stats())
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// The JSON API mirrors the HTML pages under /api/v1. It shares the session
+// cookie with the HTML pages and reuses their load* and create* functions.
+
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID is set for internal errors, to find them in the log.
+	RequestID string `json:"request_id,omitempty"`
+	// Fields has the message of each invalid field of a form.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// PublicUser is a User without the email address, which is only shown to
+// the user themselves and their friends.
+type PublicUser struct {
+	ID          int    `json:"id"`
+	AccountName string `json:"account_name"`
+	NickName    string `json:"nick_name"`
+}
+
+func publicUser(u *User) *PublicUser {
+	return &PublicUser{u.ID, u.AccountName, u.NickName}
+}
+
+type APIComment struct {
+	Comment
+	User *PublicUser `json:"user"`
+}
+
+type APIFriend struct {
+	Friend
+	User *PublicUser `json:"user"`
+}
+
+type APIFootprint struct {
+	Footprint
+	Owner *PublicUser `json:"owner"`
+}
+
+func (p Profile) MarshalJSON() ([]byte, error) {
+	type profile Profile
+	v := struct {
+		profile
+		Birthday *string `json:"birthday"`
+	}{profile: profile(p)}
+	if p.Birthday.Valid {
+		b := p.Birthday.Time.Format("2006-01-02")
+		v.Birthday = &b
+	}
+	return json.Marshal(v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e APIError) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error APIError `json:"error"`
+	}{e})
+}
+
+// decodeJSON reads a JSON body. Other content types are refused, so that
+// only requests verifyCSRF has let through without a token are read.
+func decodeJSON(r *http.Request, v interface{}) error {
+	if ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || ct != "application/json" {
+		return ErrUnsupportedMediaType
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v); err != nil {
+		return ErrBadRequest
+	}
+	return nil
+}
+
+// apiCurrentUser is authenticated for the API: no redirect, just a 401.
+func apiCurrentUser(w http.ResponseWriter, r *http.Request) (*User, error) {
+	user, err := getCurrentUser(w, r)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrAuthentication
+	}
+	return user, nil
+}
+
+func apiComments(r *http.Request, comments []Comment) ([]APIComment, error) {
+	l := loaderFor(r)
+	for _, c := range comments {
+		l.Users(c.UserID)
+	}
+	res := make([]APIComment, 0, len(comments))
+	for _, c := range comments {
+		u, err := l.User(c.UserID)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, APIComment{c, publicUser(u)})
+	}
+	return res, nil
+}
+
+func apiFriends(r *http.Request, friends []Friend) ([]APIFriend, error) {
+	l := loaderFor(r)
+	for _, f := range friends {
+		l.Users(f.ID)
+	}
+	res := make([]APIFriend, 0, len(friends))
+	for _, f := range friends {
+		u, err := l.User(f.ID)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, APIFriend{f, publicUser(u)})
+	}
+	return res, nil
+}
+
+func apiFootprints(r *http.Request, footprints []Footprint) ([]APIFootprint, error) {
+	l := loaderFor(r)
+	for _, fp := range footprints {
+		l.Users(fp.OwnerID)
+	}
+	res := make([]APIFootprint, 0, len(footprints))
+	for _, fp := range footprints {
+		u, err := l.User(fp.OwnerID)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, APIFootprint{fp, publicUser(u)})
+	}
+	return res, nil
+}
+
+func APIPostLogin(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+	if err := authenticate(w, r, req.Email, req.Password); err != nil {
+		return err
+	}
+	user, err := getCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, user)
+}
+
+func APIPostLogout(w http.ResponseWriter, r *http.Request) error {
+	session := getSession(w, r)
+	delete(session.Values, "user_id")
+	session.Options = &sessions.Options{MaxAge: -1}
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func APIGetDashboard(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	d, err := loadIndex(w, r, user)
+	if err != nil {
+		return err
+	}
+	commentsForMe, err := apiComments(r, d.CommentsForMe)
+	if err != nil {
+		return err
+	}
+	commentsOfFriends, err := apiComments(r, d.CommentsOfFriends)
+	if err != nil {
+		return err
+	}
+	friends, err := apiFriends(r, d.Friends)
+	if err != nil {
+		return err
+	}
+	footprints, err := apiFootprints(r, d.Footprints)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		User              User           `json:"user"`
+		Profile           Profile        `json:"profile"`
+		Entries           []Entry        `json:"entries"`
+		CommentsForMe     []APIComment   `json:"comments_for_me"`
+		EntriesOfFriends  []Entry        `json:"entries_of_friends"`
+		CommentsOfFriends []APIComment   `json:"comments_of_friends"`
+		Friends           []APIFriend    `json:"friends"`
+		Footprints        []APIFootprint `json:"footprints"`
+		FriendRequests    int            `json:"friend_requests"`
+		FailedLogins      []LoginAttempt `json:"failed_logins"`
+	}{
+		d.User, d.Profile, d.Entries, commentsForMe, d.EntriesOfFriends,
+		commentsOfFriends, friends, footprints,
+		d.FriendRequests, d.FailedLogins,
+	})
+}
+
+func apiProfile(d ProfileData) interface{} {
+	var owner interface{} = publicUser(&d.Owner)
+	prof := d.Profile
+	if d.Private {
+		owner = d.Owner
+	} else {
+		// the same fields profile.html hides from non-friends
+		prof = Profile{UserID: prof.UserID, FirstName: prof.FirstName, LastName: prof.LastName, UpdatedAt: prof.UpdatedAt}
+	}
+	return struct {
+		Owner   interface{} `json:"owner"`
+		Profile Profile     `json:"profile"`
+		Entries []Entry     `json:"entries"`
+	}{owner, prof, d.Entries}
+}
+
+func APIGetProfile(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	d, err := loadProfile(w, r, mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, apiProfile(d))
+}
+
+func APIPutProfile(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	account := mux.Vars(r)["account_name"]
+	if account != user.AccountName {
+		return ErrPermissionDenied
+	}
+	var form ProfileForm
+	if err := decodeJSON(r, &form); err != nil {
+		return err
+	}
+	if errs := form.validate(); len(errs) > 0 {
+		e := ErrInvalidProfile
+		writeAPIError(w, e.Status, APIError{Code: e.Code, Message: e.Message, Fields: errs})
+		return nil
+	}
+	if err := reposFor(r).Profiles.Update(user.ID, form); err != nil {
+		return err
+	}
+	d, err := loadProfile(w, r, account)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, apiProfile(d))
+}
+
+func APIListEntries(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	d, err := loadEntries(w, r, mux.Vars(r)["account_name"], pageRequest(r, 20))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Owner   *PublicUser `json:"owner"`
+		Entries []Entry     `json:"entries"`
+		Page    Page        `json:"page"`
+	}{publicUser(d.Owner), d.Entries, d.Page})
+}
+
+// writeAPIEntry loads the entry again and writes it with its first page of
+// comments.
+func writeAPIEntry(w http.ResponseWriter, r *http.Request, status int, entryID string, p PageRequest) error {
+	d, err := loadEntry(w, r, entryID, p)
+	if err != nil {
+		return err
+	}
+	comments, err := apiComments(r, d.Comments)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, status, struct {
+		Owner          *PublicUser  `json:"owner"`
+		Entry          Entry        `json:"entry"`
+		Comments       []APIComment `json:"comments"`
+		Page           Page         `json:"page"`
+		CommentsLocked bool         `json:"comments_locked"`
+	}{publicUser(d.Owner), d.Entry, comments, d.Page, d.CommentsLocked})
+}
+
+func APIGetEntry(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	return writeAPIEntry(w, r, http.StatusOK, mux.Vars(r)["entry_id"], pageRequest(r, 50))
+}
+
+func APIPostEntry(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Title   string `json:"title"`
+		Content string `json:"content"`
+		Private bool   `json:"private"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+	id, err := createEntry(r, user, req.Title, req.Content, req.Private)
+	if err != nil {
+		return err
+	}
+	return writeAPIEntry(w, r, http.StatusCreated, strconv.Itoa(id), PageRequest{Limit: 50})
+}
+
+func APIPostComment(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	var req struct {
+		Comment string `json:"comment"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+	entry, err := createComment(w, r, mux.Vars(r)["entry_id"], req.Comment)
+	if err != nil {
+		return err
+	}
+	return writeAPIEntry(w, r, http.StatusCreated, strconv.Itoa(entry.ID), PageRequest{Limit: 50})
+}
+
+func APIGetFootprints(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	footprints, page, err := reposFor(r).Footprints.List(user.ID, pageRequest(r, 50))
+	if err != nil {
+		return err
+	}
+	res, err := apiFootprints(r, footprints)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Footprints []APIFootprint `json:"footprints"`
+		Page       Page           `json:"page"`
+	}{res, page})
+}
+
+func APIGetFriends(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	friends, page, err := reposFor(r).Relations.List(user.ID, pageRequest(r, 50))
+	if err != nil {
+		return err
+	}
+	res, err := apiFriends(r, friends)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Friends []APIFriend `json:"friends"`
+		Page    Page        `json:"page"`
+	}{res, page})
+}
+
+func APIPostFriend(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	account := mux.Vars(r)["account_name"]
+	result, err := sendFriendRequest(w, r, account)
+	if err != nil {
+		return err
+	}
+	another, err := reposFor(r).Users.ByAccountName(account)
+	if err != nil {
+		return err
+	}
+	status := http.StatusOK
+	if result == FriendRequested || result == FriendAccepted {
+		status = http.StatusCreated
+	}
+	return writeJSON(w, status, struct {
+		Status string      `json:"status"`
+		User   *PublicUser `json:"user"`
+	}{result, publicUser(another)})
+}
+
+func AttachAPI(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/login", apiHandler(APIPostLogin)).Methods("POST")
+	api.HandleFunc("/logout", apiHandler(APIPostLogout)).Methods("POST")
+	api.HandleFunc("/dashboard", apiHandler(APIGetDashboard)).Methods("GET")
+	api.HandleFunc("/users/{account_name}/profile", apiHandler(APIGetProfile)).Methods("GET")
+	api.HandleFunc("/users/{account_name}/profile", apiHandler(APIPutProfile)).Methods("PUT")
+	api.HandleFunc("/users/{account_name}/entries", apiHandler(APIListEntries)).Methods("GET")
+	api.HandleFunc("/entries", apiHandler(APIPostEntry)).Methods("POST")
+	api.HandleFunc("/entries/{entry_id}", apiHandler(APIGetEntry)).Methods("GET")
+	api.HandleFunc("/entries/{entry_id}", apiHandler(APIPutEntry)).Methods("PUT")
+	api.HandleFunc("/entries/{entry_id}", apiHandler(APIDeleteEntry)).Methods("DELETE")
+	api.HandleFunc("/entries/{entry_id}/revisions", apiHandler(APIGetEntryRevisions)).Methods("GET")
+	api.HandleFunc("/entries/{entry_id}/comments", apiHandler(APIPostComment)).Methods("POST")
+	api.HandleFunc("/entries/{entry_id}/comments_locked", apiHandler(APIPutCommentsLocked)).Methods("PUT")
+	api.HandleFunc("/comments/{comment_id}", apiHandler(APIDeleteComment)).Methods("DELETE")
+	api.HandleFunc("/comments/{comment_id}/hidden", apiHandler(APIPutCommentHidden)).Methods("PUT")
+	api.HandleFunc("/footprints", apiHandler(APIGetFootprints)).Methods("GET")
+	api.HandleFunc("/friends", apiHandler(APIGetFriends)).Methods("GET")
+	api.HandleFunc("/friends/{account_name}", apiHandler(APIPostFriend)).Methods("POST")
+	api.HandleFunc("/friends/{account_name}", apiHandler(APIDeleteFriend)).Methods("DELETE")
+	api.HandleFunc("/friend_requests", apiHandler(APIGetFriendRequests)).Methods("GET")
+	api.HandleFunc("/blocks", apiHandler(APIGetBlocks)).Methods("GET")
+	api.HandleFunc("/blocks/{account_name}", apiHandler(APIPostBlock)).Methods("POST")
+	api.HandleFunc("/blocks/{account_name}", apiHandler(APIDeleteBlock)).Methods("DELETE")
+	api.HandleFunc("/friend_requests/{account_name}/accept", apiHandler(APIPostFriendRequestAccept)).Methods("POST")
+	api.HandleFunc("/friend_requests/{account_name}/decline", apiHandler(APIPostFriendRequestDecline)).Methods("POST")
+	api.HandleFunc("/friend_requests/{account_name}", apiHandler(APIDeleteFriendRequest)).Methods("DELETE")
+}
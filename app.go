@@ -1,74 +1,70 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
-	"errors"
-	"html/template"
+	"flag"
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
-	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 )
 import "net/http/pprof"
 
-var (
-	db    *sql.DB
-	store *sessions.CookieStore
-)
+var store *ServerStore
 
 type User struct {
-	ID          int
-	AccountName string
-	NickName    string
-	Email       string
+	ID          int    `json:"id"`
+	AccountName string `json:"account_name"`
+	NickName    string `json:"nick_name"`
+	Email       string `json:"email"`
 }
 
 type Profile struct {
-	UserID    int
-	FirstName string
-	LastName  string
-	Sex       string
-	Birthday  mysql.NullTime
-	Pref      string
-	UpdatedAt time.Time
+	UserID    int            `json:"user_id"`
+	FirstName string         `json:"first_name"`
+	LastName  string         `json:"last_name"`
+	Sex       string         `json:"sex"`
+	Birthday  mysql.NullTime `json:"-"`
+	Pref      string         `json:"pref"`
+	UpdatedAt time.Time      `json:"updated_at"`
 }
 
 type Entry struct {
-	ID        int
-	UserID    int
-	Private   bool
-	Title     string
-	Content   string
-	CreatedAt time.Time
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Private   bool      `json:"private"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Comment struct {
-	ID        int
-	EntryID   int
-	UserID    int
-	Comment   string
-	CreatedAt time.Time
+	ID        int       `json:"id"`
+	EntryID   int       `json:"entry_id"`
+	UserID    int       `json:"user_id"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+	Hidden    bool      `json:"hidden"`
 }
 
 type Friend struct {
-	ID        int
-	CreatedAt time.Time
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Footprint struct {
-	UserID    int
-	OwnerID   int
-	CreatedAt time.Time
-	Updated   time.Time
+	UserID    int       `json:"user_id"`
+	OwnerID   int       `json:"owner_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Updated   time.Time `json:"updated"`
 }
 
 var prefs = []string{"未入力",
@@ -76,663 +72,684 @@ var prefs = []string{"未入力",
 	"石川県", "福井県", "山梨県", "長野県", "岐阜県", "静岡県", "愛知県", "三重県", "滋賀県", "京都府", "大阪府", "兵庫県", "奈良県", "和歌山県", "鳥取県", "島根県",
 	"岡山県", "広島県", "山口県", "徳島県", "香川県", "愛媛県", "高知県", "福岡県", "佐賀県", "長崎県", "熊本県", "大分県", "宮崎県", "鹿児島県", "沖縄県"}
 
-var (
-	ErrAuthentication   = errors.New("Authentication error.")
-	ErrPermissionDenied = errors.New("Permission denied.")
-	ErrContentNotFound  = errors.New("Content not found.")
-)
-
-func authenticate(w http.ResponseWriter, r *http.Request, email, passwd string) {
-	query := `SELECT u.id AS id, u.account_name AS account_name, u.nick_name AS nick_name, u.email AS email
-FROM users u
-JOIN salts s ON u.id = s.user_id
-WHERE u.email = ? AND u.passhash = SHA2(CONCAT(?, s.salt), 512)`
-	row := db.QueryRow(query, email, passwd)
-	user := User{}
-	err := row.Scan(&user.ID, &user.AccountName, &user.NickName, &user.Email)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			checkErr(ErrAuthentication)
-		}
-		checkErr(err)
+func authenticate(w http.ResponseWriter, r *http.Request, email, passwd string) error {
+	ip := remoteIP(r)
+	if wait := loginLimiter.Wait(email, ip); wait > 0 {
+		retryAfter(w, wait)
+		return ErrTooManyLogins
+	}
+	repos := reposFor(r)
+	locked, err := accountLockedFor(repos.Logins, email)
+	if err != nil {
+		return err
+	}
+	if locked > 0 {
+		retryAfter(w, locked)
+		return ErrAccountLocked
+	}
+	user, passhash, salt, err := repos.Accounts.Credentials(email)
+	if err == ErrContentNotFound {
+		return loginFailed(r, 0, email)
+	}
+	if err != nil {
+		return err
+	}
+	hasher := hasherFor(passhash)
+	if !hasher.Verify(passwd, salt, passhash) {
+		return loginFailed(r, user.ID, email)
+	}
+	verified, err := repos.Accounts.EmailVerified(user.ID)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return ErrEmailNotVerified
+	}
+	loginLimiter.Succeed(email)
+	if err := repos.Logins.Record(user.ID, email, ip, true); err != nil {
+		return err
+	}
+	if hasher.Name() != passwordHasher.Name() || hasher.NeedsRehash(passhash) {
+		rehashPassword(repos.Accounts, user.ID, passwd, salt, passhash)
 	}
 	session := getSession(w, r)
+	if err := store.Renew(session); err != nil {
+		return err
+	}
+	delete(session.Values, "csrf_token")
+	stateOf(r).csrfToken = ""
 	session.Values["user_id"] = user.ID
-	session.Save(r, w)
+	return session.Save(r, w)
 }
 
-func getCurrentUser(w http.ResponseWriter, r *http.Request) *User {
-	u := context.Get(r, "user")
-	if u != nil {
-		user := u.(User)
-		return &user
-	}
-	session := getSession(w, r)
-	userID, ok := session.Values["user_id"]
-	if !ok || userID == nil {
-		return nil
-	}
-	row := db.QueryRow(`SELECT id, account_name, nick_name, email FROM users WHERE id=?`, userID)
-	user := User{}
-	err := row.Scan(&user.ID, &user.AccountName, &user.NickName, &user.Email)
-	if err == sql.ErrNoRows {
-		checkErr(ErrAuthentication)
+// loginFailed records a failed login; userID is 0 for unknown addresses.
+func loginFailed(r *http.Request, userID int, email string) error {
+	ip := remoteIP(r)
+	loginLimiter.Fail(email, ip)
+	if err := reposFor(r).Logins.Record(userID, email, ip, false); err != nil {
+		return err
 	}
-	checkErr(err)
-	context.Set(r, "user", user)
-	return &user
+	return ErrAuthentication
 }
 
-func authenticated(w http.ResponseWriter, r *http.Request) bool {
-	user := getCurrentUser(w, r)
-	if user == nil {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return false
+// rehashPassword upgrades a verified passhash to the configured scheme.
+// Failures are only logged since the login itself already succeeded.
+func rehashPassword(accounts AccountRepo, userID int, passwd, salt, oldHash string) {
+	newHash, err := passwordHasher.Hash(passwd, salt)
+	if err != nil {
+		log.Printf("Failed to rehash password of user %d: %s", userID, err.Error())
+		return
+	}
+	if err := accounts.Rehash(userID, oldHash, newHash); err != nil {
+		log.Printf("Failed to rehash password of user %d: %s", userID, err.Error())
 	}
-	return true
 }
 
-func getUser(w http.ResponseWriter, userID int) *User {
-	row := db.QueryRow(`SELECT * FROM users WHERE id = ?`, userID)
-	user := User{}
-	err := row.Scan(&user.ID, &user.AccountName, &user.NickName, &user.Email, new(string))
-	if err == sql.ErrNoRows {
-		checkErr(ErrContentNotFound)
+// getCurrentUser loads the user of the session, or returns nil if nobody is
+// logged in.
+func getCurrentUser(w http.ResponseWriter, r *http.Request) (*User, error) {
+	if user := currentUser(r); user != nil {
+		return user, nil
 	}
-	checkErr(err)
-	return &user
+	session := getSession(w, r)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		return nil, nil
+	}
+	user, err := reposFor(r).Users.ByID(userID)
+	if err == ErrContentNotFound {
+		return nil, ErrAuthentication
+	}
+	if err != nil {
+		return nil, err
+	}
+	stateOf(r).user = user
+	return currentUser(r), nil
 }
 
-func getUserFromAccount(w http.ResponseWriter, name string) *User {
-	row := db.QueryRow(`SELECT * FROM users WHERE account_name = ?`, name)
-	user := User{}
-	err := row.Scan(&user.ID, &user.AccountName, &user.NickName, &user.Email, new(string))
-	if err == sql.ErrNoRows {
-		checkErr(ErrContentNotFound)
+// currentUser is the user loaded by getCurrentUser, for code that only runs
+// once the request is authenticated.
+func currentUser(r *http.Request) *User {
+	u := stateOf(r).user
+	if u == nil {
+		return nil
 	}
-	checkErr(err)
+	user := *u
 	return &user
 }
 
-func isFriend(w http.ResponseWriter, r *http.Request, anotherID int) bool {
-	session := getSession(w, r)
-	id := session.Values["user_id"]
-	row := db.QueryRow(`SELECT COUNT(1) AS cnt FROM relations WHERE (one = ? AND another = ?) OR (one = ? AND another = ?)`, id, anotherID, anotherID, id)
-	cnt := new(int)
-	err := row.Scan(cnt)
-	checkErr(err)
-	return *cnt > 0
-}
-
-func isFriendAccount(w http.ResponseWriter, r *http.Request, name string) bool {
-	user := getUserFromAccount(w, name)
+// authenticated redirects to the login page unless a user is logged in.
+func authenticated(w http.ResponseWriter, r *http.Request) (bool, error) {
+	user, err := getCurrentUser(w, r)
+	if err != nil {
+		return false, err
+	}
 	if user == nil {
-		return false
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return false, nil
 	}
-	return isFriend(w, r, user.ID)
+	return true, nil
+}
+
+// isFriend needs no block check: blocking removes the relations rows and
+// friend requests are refused while a block exists.
+func isFriend(w http.ResponseWriter, r *http.Request, anotherID int) (bool, error) {
+	return friendCache.IsFriend(reposFor(r).Relations, currentUser(r).ID, anotherID)
 }
 
-func permitted(w http.ResponseWriter, r *http.Request, anotherID int) bool {
-	user := getCurrentUser(w, r)
-	if anotherID == user.ID {
-		return true
+func permitted(w http.ResponseWriter, r *http.Request, anotherID int) (bool, error) {
+	if anotherID == currentUser(r).ID {
+		return true, nil
 	}
 	return isFriend(w, r, anotherID)
 }
 
-func markFootprint(w http.ResponseWriter, r *http.Request, id int) {
-	user := getCurrentUser(w, r)
-	if user.ID != id {
-		_, err := db.Exec(`INSERT INTO footprints (user_id,owner_id) VALUES (?,?)`, id, user.ID)
-		checkErr(err)
-	}
-}
-
-func myHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			rcv := recover()
-			if rcv != nil {
-				switch {
-				case rcv == ErrAuthentication:
-					session := getSession(w, r)
-					delete(session.Values, "user_id")
-					session.Save(r, w)
-					render(w, r, http.StatusUnauthorized, "login.html", struct{ Message string }{"ログインに失敗しました"})
-					return
-				case rcv == ErrPermissionDenied:
-					render(w, r, http.StatusForbidden, "error.html", struct{ Message string }{"友人のみしかアクセスできません"})
-					return
-				case rcv == ErrContentNotFound:
-					render(w, r, http.StatusNotFound, "error.html", struct{ Message string }{"要求されたコンテンツは存在しません"})
-					return
-				default:
-					var msg string
-					if e, ok := rcv.(runtime.Error); ok {
-						msg = e.Error()
-					}
-					if s, ok := rcv.(string); ok {
-						msg = s
-					}
-					msg = rcv.(error).Error()
-					http.Error(w, msg, http.StatusInternalServerError)
-				}
-			}
-		}()
-		fn(w, r)
+// markFootprint is only called after checkNotBlocked, so blocked users
+// leave no footprints.
+func markFootprint(w http.ResponseWriter, r *http.Request, id int) error {
+	user := currentUser(r)
+	if user.ID == id {
+		return nil
 	}
+	return reposFor(r).Footprints.Add(id, user.ID)
 }
 
 func getSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
-	session, _ := store.Get(r, "isucon5q-go.session")
+	session, err := store.Get(r, sessionName)
+	if err != nil {
+		log.Printf("Failed to load session: %s", err.Error())
+	}
 	return session
 }
 
-func getTemplatePath(file string) string {
-	return path.Join("templates", file)
-}
-
-func render(w http.ResponseWriter, r *http.Request, status int, file string, data interface{}) {
-	fmap := template.FuncMap{
-		"getUser": func(id int) *User {
-			return getUser(w, id)
-		},
-		"getCurrentUser": func() *User {
-			return getCurrentUser(w, r)
-		},
-		"isFriend": func(id int) bool {
-			return isFriend(w, r, id)
-		},
-		"prefectures": func() []string {
-			return prefs
-		},
-		"substring": func(s string, l int) string {
-			if len(s) > l {
-				return s[:l]
-			}
-			return s
-		},
-		"split": strings.Split,
-		"getEntry": func(id int) Entry {
-			row := db.QueryRow(`SELECT * FROM entries WHERE id=?`, id)
-			var entryID, userID, private int
-			var body string
-			var createdAt time.Time
-			checkErr(row.Scan(&entryID, &userID, &private, &body, &createdAt))
-			return Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt}
-		},
-		"numComments": func(id int) int {
-			row := db.QueryRow(`SELECT COUNT(*) AS c FROM comments WHERE entry_id = ?`, id)
-			var n int
-			checkErr(row.Scan(&n))
-			return n
-		},
-	}
-	tpl := template.Must(template.New(file).Funcs(fmap).ParseFiles(getTemplatePath(file), getTemplatePath("header.html")))
+// render executes the page into a buffer first, so that a failing template
+// still leaves the response to the error handler, and a form which creates
+// the session for its CSRF token can still set the cookie.
+func render(w http.ResponseWriter, r *http.Request, status int, file string, data interface{}) error {
+	tpl, err := templates.Page(file)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	start := time.Now()
+	if err := tpl.Execute(&buf, &pageView{data, w, r}); err != nil {
+		return err
+	}
+	metrics.ObserveRender(file, time.Since(start))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(status)
-	checkErr(tpl.Execute(w, data))
+	_, err = buf.WriteTo(w)
+	return err
 }
 
-func GetLogin(w http.ResponseWriter, r *http.Request) {
-	render(w, r, http.StatusOK, "login.html", struct{ Message string }{"高負荷に耐えられるSNSコミュニティサイトへようこそ!"})
+func GetLogin(w http.ResponseWriter, r *http.Request) error {
+	return render(w, r, http.StatusOK, "login.html", struct{ Message string }{"高負荷に耐えられるSNSコミュニティサイトへようこそ!"})
 }
 
-func PostLogin(w http.ResponseWriter, r *http.Request) {
+func PostLogin(w http.ResponseWriter, r *http.Request) error {
 	email := r.FormValue("email")
 	passwd := r.FormValue("password")
-	authenticate(w, r, email, passwd)
+	if err := authenticate(w, r, email, passwd); err != nil {
+		return err
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
 }
 
-func GetLogout(w http.ResponseWriter, r *http.Request) {
+func PostLogout(w http.ResponseWriter, r *http.Request) error {
 	session := getSession(w, r)
 	delete(session.Values, "user_id")
 	session.Options = &sessions.Options{MaxAge: -1}
 	session.Save(r, w)
-	http.Redirect(w, r, "/login", http.StatusFound)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil
 }
 
-func GetIndex(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+// PostLogoutAll revokes every session of the current user, on all devices.
+func PostLogoutAll(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+	if err := store.Backend.DeleteByUser(currentUser(r).ID); err != nil {
+		return err
+	}
+	session := getSession(w, r)
+	session.Options = &sessions.Options{MaxAge: -1}
+	if err := session.Save(r, w); err != nil {
+		return err
 	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil
+}
 
-	user := getCurrentUser(w, r)
-
-	prof := Profile{}
-	row := db.QueryRow(`SELECT * FROM profiles WHERE user_id = ?`, user.ID)
-	err := row.Scan(&prof.UserID, &prof.FirstName, &prof.LastName, &prof.Sex, &prof.Birthday, &prof.Pref, &prof.UpdatedAt)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-
-	rows, err := db.Query(`SELECT * FROM entries WHERE user_id = ? ORDER BY created_at LIMIT 5`, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	entries := make([]Entry, 0, 5)
-	for rows.Next() {
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &userID, &private, &body, &createdAt))
-		entries = append(entries, Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt})
-	}
-	rows.Close()
-
-	rows, err = db.Query(`SELECT c.id AS id, c.entry_id AS entry_id, c.user_id AS user_id, c.comment AS comment, c.created_at AS created_at
-FROM comments c
-JOIN entries e ON c.entry_id = e.id
-WHERE e.user_id = ?
-ORDER BY c.created_at DESC
-LIMIT 10`, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	commentsForMe := make([]Comment, 0, 10)
-	for rows.Next() {
-		c := Comment{}
-		checkErr(rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt))
-		commentsForMe = append(commentsForMe, c)
-	}
-	rows.Close()
-
-	rows, err = db.Query(`SELECT * FROM entries ORDER BY created_at DESC LIMIT 1000`)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	entriesOfFriends := make([]Entry, 0, 10)
-	for rows.Next() {
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &userID, &private, &body, &createdAt))
-		if !isFriend(w, r, userID) {
-			continue
-		}
-		entriesOfFriends = append(entriesOfFriends, Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt})
-		if len(entriesOfFriends) >= 10 {
-			break
-		}
+// IndexData is the dashboard of the current user.
+type IndexData struct {
+	User              User
+	Profile           Profile
+	Entries           []Entry
+	CommentsForMe     []Comment
+	EntriesOfFriends  []Entry
+	CommentsOfFriends []Comment
+	Friends           []Friend
+	Footprints        []Footprint
+	FriendRequests    int
+	FailedLogins      []LoginAttempt
+}
+
+func GetIndex(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
 	}
-	rows.Close()
 
-	rows, err = db.Query(`SELECT * FROM comments ORDER BY created_at DESC LIMIT 1000`)
-	if err != sql.ErrNoRows {
-		checkErr(err)
+	d, err := loadIndex(w, r, currentUser(r))
+	if err != nil {
+		return err
 	}
-	commentsOfFriends := make([]Comment, 0, 10)
-	for rows.Next() {
-		c := Comment{}
-		checkErr(rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt))
-		if !isFriend(w, r, c.UserID) {
-			continue
-		}
-		row := db.QueryRow(`SELECT * FROM entries WHERE id = ?`, c.EntryID)
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		checkErr(row.Scan(&id, &userID, &private, &body, &createdAt))
-		entry := Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt}
-		if entry.Private {
-			if !permitted(w, r, entry.UserID) {
-				continue
-			}
-		}
-		commentsOfFriends = append(commentsOfFriends, c)
-		if len(commentsOfFriends) >= 10 {
-			break
-		}
+	return render(w, r, http.StatusOK, "index.html", d)
+}
+
+func loadIndex(w http.ResponseWriter, r *http.Request, user *User) (IndexData, error) {
+	repos := reposFor(r)
+	prof, err := repos.Profiles.Get(user.ID)
+	if err != nil {
+		return IndexData{}, err
 	}
-	rows.Close()
-
-	rows, err = db.Query(`SELECT * FROM relations WHERE one = ? OR another = ? ORDER BY created_at DESC`, user.ID, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	friendsMap := make(map[int]time.Time)
-	for rows.Next() {
-		var id, one, another int
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &one, &another, &createdAt))
-		var friendID int
-		if one == user.ID {
-			friendID = another
-		} else {
-			friendID = one
-		}
-		if _, ok := friendsMap[friendID]; !ok {
-			friendsMap[friendID] = createdAt
-		}
+
+	entries, err := repos.Entries.ByUser(user.ID, true, 5)
+	if err != nil {
+		return IndexData{}, err
+	}
+
+	commentsForMe, err := repos.Comments.ForOwner(user.ID, 10)
+	if err != nil {
+		return IndexData{}, err
+	}
+
+	entriesOfFriends, err := repos.Timeline.Entries(user.ID, 10)
+	if err != nil {
+		return IndexData{}, err
+	}
+	commentsOfFriends, err := repos.Timeline.Comments(user.ID, 10)
+	if err != nil {
+		return IndexData{}, err
+	}
+
+	friendsMap, err := friendCache.Friends(repos.Relations, user.ID)
+	if err != nil {
+		return IndexData{}, err
 	}
 	friends := make([]Friend, 0, len(friendsMap))
 	for key, val := range friendsMap {
 		friends = append(friends, Friend{key, val})
 	}
-	rows.Close()
-
-	rows, err = db.Query(`SELECT user_id, owner_id, DATE(created_at) AS date, MAX(created_at) AS updated
-FROM footprints
-WHERE user_id = ?
-GROUP BY user_id, owner_id, DATE(created_at)
-ORDER BY updated DESC
-LIMIT 10`, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	footprints := make([]Footprint, 0, 10)
-	for rows.Next() {
-		fp := Footprint{}
-		checkErr(rows.Scan(&fp.UserID, &fp.OwnerID, &fp.CreatedAt, &fp.Updated))
-		footprints = append(footprints, fp)
-	}
-	rows.Close()
-
-	render(w, r, http.StatusOK, "index.html", struct {
-		User              User
-		Profile           Profile
-		Entries           []Entry
-		CommentsForMe     []Comment
-		EntriesOfFriends  []Entry
-		CommentsOfFriends []Comment
-		Friends           []Friend
-		Footprints        []Footprint
-	}{
+
+	footprints, _, err := repos.Footprints.List(user.ID, PageRequest{Limit: 10})
+	if err != nil {
+		return IndexData{}, err
+	}
+
+	friendRequests, err := repos.FriendRequests.Count(user.ID)
+	if err != nil {
+		return IndexData{}, err
+	}
+
+	failedLogins, err := repos.Logins.Failed(user.ID, 5)
+	if err != nil {
+		return IndexData{}, err
+	}
+
+	l := loaderFor(r)
+	for _, fp := range footprints {
+		l.Users(fp.OwnerID)
+	}
+	for _, c := range commentsForMe {
+		l.Users(c.UserID)
+	}
+	for _, e := range entriesOfFriends {
+		l.Users(e.UserID)
+	}
+	for _, c := range commentsOfFriends {
+		l.Users(c.UserID)
+		l.Entries(c.EntryID)
+	}
+
+	return IndexData{
 		*user, prof, entries, commentsForMe, entriesOfFriends, commentsOfFriends, friends, footprints,
-	})
+		friendRequests, failedLogins,
+	}, nil
 }
 
-func GetProfile(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+// ProfileData is a user's profile page as seen by the current user.
+type ProfileData struct {
+	Owner   User
+	Profile Profile
+	Entries []Entry
+	Private bool
+	// FriendRequest is "incoming" or "outgoing" while a request between the
+	// current user and Owner is pending.
+	FriendRequest string
+	// Form fills the profile form, and Errors has the messages of its
+	// invalid fields after a failed update.
+	Form   ProfileForm
+	Errors map[string]string
+}
+
+func GetProfile(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
 	}
 
 	account := mux.Vars(r)["account_name"]
-	owner := getUserFromAccount(w, account)
-	row := db.QueryRow(`SELECT * FROM profiles WHERE user_id = ?`, owner.ID)
-	prof := Profile{}
-	err := row.Scan(&prof.UserID, &prof.FirstName, &prof.LastName, &prof.Sex, &prof.Birthday, &prof.Pref, &prof.UpdatedAt)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	var query string
-	if permitted(w, r, owner.ID) {
-		query = `SELECT * FROM entries WHERE user_id = ? ORDER BY created_at LIMIT 5`
-	} else {
-		query = `SELECT * FROM entries WHERE user_id = ? AND private=0 ORDER BY created_at LIMIT 5`
-	}
-	rows, err := db.Query(query, owner.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	entries := make([]Entry, 0, 5)
-	for rows.Next() {
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &userID, &private, &body, &createdAt))
-		entry := Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt}
-		entries = append(entries, entry)
-	}
-	rows.Close()
-
-	markFootprint(w, r, owner.ID)
-
-	render(w, r, http.StatusOK, "profile.html", struct {
-		Owner   User
-		Profile Profile
-		Entries []Entry
-		Private bool
-	}{
-		*owner, prof, entries, permitted(w, r, owner.ID),
-	})
-}
-
-func PostProfile(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+	d, err := loadProfile(w, r, account)
+	if err == ErrContentNotFound {
+		if ok, err := redirectRenamed(w, r, "/profile/", account); ok || err != nil {
+			return err
+		}
 	}
-	user := getCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	return render(w, r, http.StatusOK, "profile.html", d)
+}
+
+func loadProfile(w http.ResponseWriter, r *http.Request, account string) (ProfileData, error) {
+	owner, err := reposFor(r).Users.ByAccountName(account)
+	if err != nil {
+		return ProfileData{}, err
+	}
+	if err := checkNotBlocked(w, r, owner.ID); err != nil {
+		return ProfileData{}, err
+	}
+	prof, err := reposFor(r).Profiles.Get(owner.ID)
+	if err != nil {
+		return ProfileData{}, err
+	}
+	ok, err := permitted(w, r, owner.ID)
+	if err != nil {
+		return ProfileData{}, err
+	}
+	entries, err := reposFor(r).Entries.ByUser(owner.ID, ok, 5)
+	if err != nil {
+		return ProfileData{}, err
+	}
+
+	if err := markFootprint(w, r, owner.ID); err != nil {
+		return ProfileData{}, err
+	}
+
+	pending, err := reposFor(r).FriendRequests.Pending(currentUser(r).ID, owner.ID)
+	if err != nil {
+		return ProfileData{}, err
+	}
+	return ProfileData{*owner, prof, entries, ok, pending, profileFormOf(prof), nil}, nil
+}
+
+func PostProfile(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+	user := currentUser(r)
 	account := mux.Vars(r)["account_name"]
 	if account != user.AccountName {
-		checkErr(ErrPermissionDenied)
-	}
-	query := `UPDATE profiles
-SET first_name=?, last_name=?, sex=?, birthday=?, pref=?, updated_at=CURRENT_TIMESTAMP()
-WHERE user_id = ?`
-	birth := r.FormValue("birthday")
-	firstName := r.FormValue("first_name")
-	lastName := r.FormValue("last_name")
-	sex := r.FormValue("sex")
-	pref := r.FormValue("pref")
-	_, err := db.Exec(query, firstName, lastName, sex, birth, pref, user.ID)
-	checkErr(err)
+		return ErrPermissionDenied
+	}
+	form := ProfileForm{
+		FirstName: r.FormValue("first_name"),
+		LastName:  r.FormValue("last_name"),
+		Sex:       r.FormValue("sex"),
+		Birthday:  r.FormValue("birthday"),
+		Pref:      r.FormValue("pref"),
+	}
+	if errs := form.validate(); len(errs) > 0 {
+		d, err := loadProfile(w, r, account)
+		if err != nil {
+			return err
+		}
+		d.Form, d.Errors = form, errs
+		return render(w, r, http.StatusBadRequest, "profile.html", d)
+	}
+	if err := reposFor(r).Profiles.Update(user.ID, form); err != nil {
+		return err
+	}
 	// TODO should escape the account name?
 	http.Redirect(w, r, "/profile/"+account, http.StatusSeeOther)
+	return nil
 }
 
-func ListEntries(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+// EntriesData is the diary of a user as seen by the current user.
+type EntriesData struct {
+	Owner   *User
+	Entries []Entry
+	Myself  bool
+	Page    Page
+}
+
+func ListEntries(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
 	}
 
 	account := mux.Vars(r)["account_name"]
-	owner := getUserFromAccount(w, account)
-	var query string
-	if permitted(w, r, owner.ID) {
-		query = `SELECT * FROM entries WHERE user_id = ? ORDER BY created_at DESC LIMIT 20`
-	} else {
-		query = `SELECT * FROM entries WHERE user_id = ? AND private=0 ORDER BY created_at DESC LIMIT 20`
-	}
-	rows, err := db.Query(query, owner.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	entries := make([]Entry, 0, 20)
-	for rows.Next() {
-		var id, userID, private int
-		var body string
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &userID, &private, &body, &createdAt))
-		entry := Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt}
-		entries = append(entries, entry)
-	}
-	rows.Close()
-
-	markFootprint(w, r, owner.ID)
-
-	render(w, r, http.StatusOK, "entries.html", struct {
-		Owner   *User
-		Entries []Entry
-		Myself  bool
-	}{owner, entries, getCurrentUser(w, r).ID == owner.ID})
-}
-
-func GetEntry(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+	d, err := loadEntries(w, r, account, pageRequest(r, 20))
+	if err == ErrContentNotFound {
+		if ok, err := redirectRenamed(w, r, "/diary/entries/", account); ok || err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return render(w, r, http.StatusOK, "entries.html", d)
+}
+
+func loadEntries(w http.ResponseWriter, r *http.Request, account string, p PageRequest) (EntriesData, error) {
+	owner, err := reposFor(r).Users.ByAccountName(account)
+	if err != nil {
+		return EntriesData{}, err
+	}
+	if err := checkNotBlocked(w, r, owner.ID); err != nil {
+		return EntriesData{}, err
+	}
+	ok, err := permitted(w, r, owner.ID)
+	if err != nil {
+		return EntriesData{}, err
+	}
+	entries, page, err := reposFor(r).Entries.List(owner.ID, ok, p)
+	if err != nil {
+		return EntriesData{}, err
+	}
+
+	if err := markFootprint(w, r, owner.ID); err != nil {
+		return EntriesData{}, err
+	}
+
+	return EntriesData{owner, entries, currentUser(r).ID == owner.ID, page}, nil
+}
+
+// entryParam loads the entry named by an {entry_id} path variable, unless it
+// has been deleted.
+func entryParam(r *http.Request, entryID string) (Entry, error) {
+	id, err := strconv.Atoi(entryID)
+	if err != nil {
+		return Entry{}, ErrContentNotFound
+	}
+	return reposFor(r).Entries.Get(id)
+}
+
+// readableEntry loads an entry the current user may read, with its owner.
+func readableEntry(w http.ResponseWriter, r *http.Request, entryID string) (Entry, *User, error) {
+	entry, err := entryParam(r, entryID)
+	if err != nil {
+		return Entry{}, nil, err
+	}
+	owner, err := reposFor(r).Users.ByID(entry.UserID)
+	if err != nil {
+		return Entry{}, nil, err
+	}
+	if err := checkNotBlocked(w, r, owner.ID); err != nil {
+		return Entry{}, nil, err
 	}
-	entryID := mux.Vars(r)["entry_id"]
-	row := db.QueryRow(`SELECT * FROM entries WHERE id = ?`, entryID)
-	var id, userID, private int
-	var body string
-	var createdAt time.Time
-	err := row.Scan(&id, &userID, &private, &body, &createdAt)
-	if err == sql.ErrNoRows {
-		checkErr(ErrContentNotFound)
-	}
-	checkErr(err)
-	entry := Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt}
-	owner := getUser(w, entry.UserID)
 	if entry.Private {
-		if !permitted(w, r, owner.ID) {
-			checkErr(ErrPermissionDenied)
+		ok, err := permitted(w, r, owner.ID)
+		if err != nil {
+			return Entry{}, nil, err
+		}
+		if !ok {
+			return Entry{}, nil, ErrPermissionDenied
 		}
 	}
-	rows, err := db.Query(`SELECT * FROM comments WHERE entry_id = ?`, entry.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
+	return entry, owner, nil
+}
+
+// EntryData is a diary entry with its comments.
+type EntryData struct {
+	Owner          *User
+	Entry          Entry
+	Comments       []Comment
+	Page           Page
+	CommentsLocked bool
+}
+
+func GetEntry(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
 	}
-	comments := make([]Comment, 0, 10)
-	for rows.Next() {
-		c := Comment{}
-		checkErr(rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt))
-		comments = append(comments, c)
+	d, err := loadEntry(w, r, mux.Vars(r)["entry_id"], pageRequest(r, 50))
+	if err != nil {
+		return err
 	}
-	rows.Close()
+	return render(w, r, http.StatusOK, "entry.html", d)
+}
 
-	markFootprint(w, r, owner.ID)
+func loadEntry(w http.ResponseWriter, r *http.Request, entryID string, p PageRequest) (EntryData, error) {
+	entry, owner, err := readableEntry(w, r, entryID)
+	if err != nil {
+		return EntryData{}, err
+	}
+	// only the entry owner sees the comments they have hidden
+	comments, page, err := reposFor(r).Comments.List(entry.ID, owner.ID == currentUser(r).ID, p)
+	if err != nil {
+		return EntryData{}, err
+	}
+	for _, c := range comments {
+		loaderFor(r).Users(c.UserID)
+	}
 
-	render(w, r, http.StatusOK, "entry.html", struct {
-		Owner    *User
-		Entry    Entry
-		Comments []Comment
-	}{owner, entry, comments})
-}
+	if err := markFootprint(w, r, owner.ID); err != nil {
+		return EntryData{}, err
+	}
 
-func PostEntry(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+	locked, err := reposFor(r).Entries.CommentsLocked(entry.ID)
+	if err != nil {
+		return EntryData{}, err
 	}
+	return EntryData{owner, entry, comments, page, locked}, nil
+}
 
-	user := getCurrentUser(w, r)
-	title := r.FormValue("title")
-	if title == "" {
-		title = "タイトルなし"
+func PostEntry(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
 	}
-	content := r.FormValue("content")
-	var private int
-	if r.FormValue("private") == "" {
-		private = 0
-	} else {
-		private = 1
+
+	user := currentUser(r)
+	if _, err := createEntry(r, user, r.FormValue("title"), r.FormValue("content"), r.FormValue("private") != ""); err != nil {
+		return err
 	}
-	_, err := db.Exec(`INSERT INTO entries (user_id, private, body) VALUES (?,?,?)`, user.ID, private, title+"\n"+content)
-	checkErr(err)
 	http.Redirect(w, r, "/diary/entries/"+user.AccountName, http.StatusSeeOther)
+	return nil
 }
 
-func PostComment(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+func createEntry(r *http.Request, user *User, title, content string, isPrivate bool) (int, error) {
+	id, err := reposFor(r).Entries.Create(user.ID, entryTitle(title), content, isPrivate)
+	if err != nil {
+		return 0, err
 	}
+	return id, reposFor(r).Timeline.AddEntry(id)
+}
 
-	entryID := mux.Vars(r)["entry_id"]
-	row := db.QueryRow(`SELECT * FROM entries WHERE id = ?`, entryID)
-	var id, userID, private int
-	var body string
-	var createdAt time.Time
-	err := row.Scan(&id, &userID, &private, &body, &createdAt)
-	if err == sql.ErrNoRows {
-		checkErr(ErrContentNotFound)
+func PostComment(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
 	}
-	checkErr(err)
 
-	entry := Entry{id, userID, private == 1, strings.SplitN(body, "\n", 2)[0], strings.SplitN(body, "\n", 2)[1], createdAt}
-	owner := getUser(w, entry.UserID)
-	if entry.Private {
-		if !permitted(w, r, owner.ID) {
-			checkErr(ErrPermissionDenied)
+	entry, err := createComment(w, r, mux.Vars(r)["entry_id"], r.FormValue("comment"))
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entry.ID), http.StatusSeeOther)
+	return nil
+}
+
+// createComment posts comment on the entry as the current user.
+func createComment(w http.ResponseWriter, r *http.Request, entryID string, comment string) (Entry, error) {
+	entry, owner, err := readableEntry(w, r, entryID)
+	if err != nil {
+		return Entry{}, err
+	}
+	user := currentUser(r)
+	if user.ID != owner.ID {
+		locked, err := reposFor(r).Entries.CommentsLocked(entry.ID)
+		if err != nil {
+			return Entry{}, err
+		}
+		if locked {
+			return Entry{}, ErrPermissionDenied
 		}
 	}
-	user := getCurrentUser(w, r)
 
-	_, err = db.Exec(`INSERT INTO comments (entry_id, user_id, comment) VALUES (?,?,?)`, entry.ID, user.ID, r.FormValue("comment"))
-	checkErr(err)
-	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entry.ID), http.StatusSeeOther)
+	id, err := reposFor(r).Comments.Create(entry.ID, user.ID, comment)
+	if err != nil {
+		return Entry{}, err
+	}
+	return entry, reposFor(r).Timeline.AddComment(id)
 }
 
-func GetFootprints(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+func GetFootprints(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
 	}
 
-	user := getCurrentUser(w, r)
-	footprints := make([]Footprint, 0, 50)
-	rows, err := db.Query(`SELECT user_id, owner_id, DATE(created_at) AS date, MAX(created_at) as updated
-FROM footprints
-WHERE user_id = ?
-GROUP BY user_id, owner_id, DATE(created_at)
-ORDER BY updated DESC
-LIMIT 50`, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
+	footprints, page, err := reposFor(r).Footprints.List(currentUser(r).ID, pageRequest(r, 50))
+	if err != nil {
+		return err
 	}
-	for rows.Next() {
-		fp := Footprint{}
-		checkErr(rows.Scan(&fp.UserID, &fp.OwnerID, &fp.CreatedAt, &fp.Updated))
-		footprints = append(footprints, fp)
+	for _, fp := range footprints {
+		loaderFor(r).Users(fp.OwnerID)
 	}
-	rows.Close()
-	render(w, r, http.StatusOK, "footprints.html", struct{ Footprints []Footprint }{footprints})
+	return render(w, r, http.StatusOK, "footprints.html", struct {
+		Footprints []Footprint
+		Page       Page
+	}{footprints, page})
 }
-func GetFriends(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+
+func GetFriends(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
 	}
 
-	user := getCurrentUser(w, r)
-	rows, err := db.Query(`SELECT * FROM relations WHERE one = ? OR another = ? ORDER BY created_at DESC`, user.ID, user.ID)
-	if err != sql.ErrNoRows {
-		checkErr(err)
-	}
-	friendsMap := make(map[int]time.Time)
-	for rows.Next() {
-		var id, one, another int
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &one, &another, &createdAt))
-		var friendID int
-		if one == user.ID {
-			friendID = another
-		} else {
-			friendID = one
-		}
-		if _, ok := friendsMap[friendID]; !ok {
-			friendsMap[friendID] = createdAt
-		}
+	friends, page, err := reposFor(r).Relations.List(currentUser(r).ID, pageRequest(r, 50))
+	if err != nil {
+		return err
 	}
-	rows.Close()
-	friends := make([]Friend, 0, len(friendsMap))
-	for key, val := range friendsMap {
-		friends = append(friends, Friend{key, val})
+	for _, f := range friends {
+		loaderFor(r).Users(f.ID)
 	}
-	render(w, r, http.StatusOK, "friends.html", struct{ Friends []Friend }{friends})
+	return render(w, r, http.StatusOK, "friends.html", struct {
+		Friends []Friend
+		Page    Page
+	}{friends, page})
 }
 
-func PostFriends(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+func PostFriends(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
 	}
 
-	user := getCurrentUser(w, r)
-	anotherAccount := mux.Vars(r)["account_name"]
-	if !isFriendAccount(w, r, anotherAccount) {
-		another := getUserFromAccount(w, anotherAccount)
-		_, err := db.Exec(`INSERT INTO relations (one, another) VALUES (?,?), (?,?)`, user.ID, another.ID, another.ID, user.ID)
-		checkErr(err)
+	result, err := sendFriendRequest(w, r, mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if result == FriendAccepted {
 		http.Redirect(w, r, "/friends", http.StatusSeeOther)
+		return nil
 	}
+	http.Redirect(w, r, "/friends/requests", http.StatusSeeOther)
+	return nil
 }
 
-func GetInitialize(w http.ResponseWriter, r *http.Request) {
-	db.Exec("DELETE FROM relations WHERE id > 500000")
-	db.Exec("DELETE FROM footprints WHERE id > 500000")
-	db.Exec("DELETE FROM entries WHERE id > 500000")
-	db.Exec("DELETE FROM comments WHERE id > 1500000")
+func GetInitialize(w http.ResponseWriter, r *http.Request) error {
+	if err := reposFor(r).Admin.Initialize(); err != nil {
+		return err
+	}
+	if err := store.Backend.DeleteAll(); err != nil {
+		return err
+	}
+	friendCache.Purge()
+	loginLimiter.Purge()
+	mailLimiter.Purge()
+	return nil
 }
 
 func AttachProfiler(router *mux.Router) {
-	router.HandleFunc("/debug/pprof/", pprof.Index)
-	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	router.HandleFunc("/debug/pprof/block", pprof.Handler("block").ServeHTTP)
-	router.HandleFunc("/debug/pprof/heap", pprof.Handler("heap").ServeHTTP)
-	router.HandleFunc("/debug/pprof/goroutine", pprof.Handler("goroutine").ServeHTTP)
-	router.HandleFunc("/debug/pprof/threadcreate", pprof.Handler("threadcreate").ServeHTTP)
+	p := router.PathPrefix("/debug/pprof").Subrouter()
+	p.Handle("/", requireAdmin(http.HandlerFunc(pprof.Index)))
+	p.Handle("/cmdline", requireAdmin(http.HandlerFunc(pprof.Cmdline)))
+	p.Handle("/profile", requireAdmin(http.HandlerFunc(pprof.Profile)))
+	p.Handle("/symbol", requireAdmin(http.HandlerFunc(pprof.Symbol)))
+	p.Handle("/block", requireAdmin(pprof.Handler("block")))
+	p.Handle("/heap", requireAdmin(pprof.Handler("heap")))
+	p.Handle("/goroutine", requireAdmin(pprof.Handler("goroutine")))
+	p.Handle("/threadcreate", requireAdmin(pprof.Handler("threadcreate")))
 }
 
 func main() {
+	rebuild := flag.Bool("rebuild-timeline", false, "rebuild the timelines of all users and exit")
+	backfill := flag.Bool("backfill-entries", false, "fill in title and content of entries from body and exit")
+	backfillAfter := flag.Int("backfill-after", 0, "with -backfill-entries, start after this entry ID")
+	backfillChunk := flag.Int("backfill-chunk", 1000, "with -backfill-entries, entries updated per transaction")
+	dev := flag.Bool("dev", false, "reload templates when they change")
+	flag.Parse()
+
 	runtime.SetBlockProfileRate(1)
 	host := os.Getenv("ISUCON5_DB_HOST")
 	if host == "" {
@@ -755,26 +772,178 @@ func main() {
 	if dbname == "" {
 		dbname = "isucon5q"
 	}
-	ssecret := os.Getenv("ISUCON5_SESSION_SECRET")
-	if ssecret == "" {
-		ssecret = "beermoris"
+	hasherName := os.Getenv("ISUCON5_PASSWORD_HASHER")
+	if hasherName == "" {
+		hasherName = "sha512"
+	}
+	hasher, ok := passwordHashers[hasherName]
+	if !ok {
+		log.Fatalf("Unknown password hasher in ISUCON5_PASSWORD_HASHER: %s.", hasherName)
+	}
+	passwordHasher = hasher
+	idleTimeout, err := time.ParseDuration(getEnv("ISUCON5_SESSION_IDLE_TIMEOUT", "168h"))
+	if err != nil {
+		log.Fatalf("Failed to read ISUCON5_SESSION_IDLE_TIMEOUT.\nError: %s", err.Error())
+	}
+	anonymousTimeout, err := time.ParseDuration(getEnv("ISUCON5_SESSION_ANONYMOUS_TIMEOUT", "1h"))
+	if err != nil {
+		log.Fatalf("Failed to read ISUCON5_SESSION_ANONYMOUS_TIMEOUT.\nError: %s", err.Error())
+	}
+	maxAge, err := time.ParseDuration(getEnv("ISUCON5_SESSION_MAX_AGE", "720h"))
+	if err != nil {
+		log.Fatalf("Failed to read ISUCON5_SESSION_MAX_AGE.\nError: %s", err.Error())
+	}
+	adminToken = os.Getenv("ISUCON5_ADMIN_TOKEN")
+	lockoutThreshold, err = strconv.Atoi(getEnv("ISUCON5_LOGIN_LOCKOUT_THRESHOLD", "10"))
+	if err != nil {
+		log.Fatalf("Failed to read ISUCON5_LOGIN_LOCKOUT_THRESHOLD.\nError: %s", err.Error())
+	}
+	lockoutDuration, err = time.ParseDuration(getEnv("ISUCON5_LOGIN_LOCKOUT", "15m"))
+	if err != nil {
+		log.Fatalf("Failed to read ISUCON5_LOGIN_LOCKOUT.\nError: %s", err.Error())
+	}
+	adminAllow, err = parseAllowlist(getEnv("ISUCON5_ADMIN_ALLOW", "127.0.0.1/8,::1"))
+	if err != nil {
+		log.Fatalf("Failed to read ISUCON5_ADMIN_ALLOW.\nError: %s", err.Error())
+	}
+	friendCacheEdges, err := strconv.Atoi(getEnv("ISUCON5_FRIEND_CACHE_EDGES", "1000000"))
+	if err != nil {
+		log.Fatalf("Failed to read ISUCON5_FRIEND_CACHE_EDGES.\nError: %s", err.Error())
+	}
+	friendCache = NewFriendCache(friendCacheEdges)
+	switch logFormat = getEnv("ISUCON5_LOG_FORMAT", "logfmt"); logFormat {
+	case "logfmt", "json":
+	default:
+		log.Fatalf("Unknown log format in ISUCON5_LOG_FORMAT: %s.", logFormat)
+	}
+	switch sqlLogMode = getEnv("ISUCON5_SQL_LOG", "slow"); sqlLogMode {
+	case "off", "slow", "all":
+	default:
+		log.Fatalf("Unknown SQL log mode in ISUCON5_SQL_LOG: %s.", sqlLogMode)
+	}
+	sqlSlowThreshold, err = time.ParseDuration(getEnv("ISUCON5_SQL_SLOW", "100ms"))
+	if err != nil {
+		log.Fatalf("Failed to read ISUCON5_SQL_SLOW.\nError: %s", err.Error())
 	}
 
-	db, err = sql.Open("mysql", user+":"+password+"@tcp("+host+":"+strconv.Itoa(port)+")/"+dbname+"?loc=Local&parseTime=true")
+	conn, err := sql.Open("mysql", user+":"+password+"@tcp("+host+":"+strconv.Itoa(port)+")/"+dbname+"?loc=Local&parseTime=true")
 	if err != nil {
 		log.Fatalf("Failed to connect to DB: %s.", err.Error())
 	}
+	db := NewDB(conn)
 	defer db.Close()
 
-	store = sessions.NewCookieStore([]byte(ssecret))
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(db, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("Failed to migrate: %s.", err.Error())
+		}
+		return
+	}
+	if err := checkSchema(db); err != nil {
+		log.Fatalf("Database schema is behind this binary: %s.", err.Error())
+	}
+	if err := checkColumns(db); err != nil {
+		log.Fatalf("Database schema does not fit the queries: %s.", err.Error())
+	}
 
+	if *rebuild {
+		if err := rebuildTimeline(db); err != nil {
+			log.Fatalf("Failed to rebuild timelines: %s.", err.Error())
+		}
+		return
+	}
+	if *backfill {
+		if err := backfillEntries(db, *backfillAfter, *backfillChunk); err != nil {
+			log.Fatalf("Failed to backfill entries: %s.", err.Error())
+		}
+		return
+	}
+
+	templates, err = NewTemplateRegistry("templates")
+	if err != nil {
+		log.Fatalf("Failed to parse templates: %s.", err.Error())
+	}
+	if *dev {
+		go templates.Watch(time.Second)
+	}
+
+	switch name := getEnv("ISUCON5_MAILER", "stdout"); name {
+	case "stdout":
+		mailer = &WriterMailer{W: os.Stdout}
+	case "file":
+		mailer = &FileMailer{Dir: getEnv("ISUCON5_MAIL_DIR", "mail")}
+	case "smtp":
+		mailer = &SMTPMailer{Addr: getEnv("ISUCON5_SMTP_ADDR", "localhost:25")}
+	default:
+		log.Fatalf("Unknown mailer in ISUCON5_MAILER: %s.", name)
+	}
+	mailFrom = getEnv("ISUCON5_MAIL_FROM", mailFrom)
+	baseURL = strings.TrimSuffix(getEnv("ISUCON5_BASE_URL", baseURL), "/")
+
+	var backend SessionBackend
+	switch name := getEnv("ISUCON5_SESSION_BACKEND", "mysql"); name {
+	case "mysql":
+		backend = &MySQLSessionBackend{DB: db.DB}
+	case "memory":
+		backend = NewMemorySessionBackend()
+	default:
+		log.Fatalf("Unknown session backend in ISUCON5_SESSION_BACKEND: %s.", name)
+	}
+	store = NewServerStore(backend, idleTimeout, maxAge)
+	store.AnonymousTimeout = anonymousTimeout
+	go store.GC(10 * time.Minute)
+	go loginLimiter.GC(10 * time.Minute)
+	go mailLimiter.GC(10 * time.Minute)
+
+	metrics.DB = db.DB
+
+	site := MySQLRepos(db)
+	addr := os.Getenv("ISUCON5_ADMIN_ADDR")
+	if addr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, NewAdminServer(site)))
+		}()
+	}
+	log.Fatal(http.ListenAndServe(":8080", NewServer(site, addr == "")))
+}
+
+// NewServer builds the site on the repositories of repos, with the admin
+// endpoints unless they are served on their own address.
+func NewServer(repos RepoSource, admin bool) http.Handler {
 	r := mux.NewRouter()
-	AttachProfiler(r)
+	if admin {
+		AttachAdmin(r)
+	}
+	AttachSite(r)
+	return withRepos(repos, accessLog(r))
+}
 
+// NewAdminServer builds the admin endpoints alone, for ISUCON5_ADMIN_ADDR.
+func NewAdminServer(repos RepoSource) http.Handler {
+	r := mux.NewRouter()
+	AttachAdmin(r)
+	return withRepos(repos, accessLog(r))
+}
+
+// AttachSite mounts the pages, the JSON API and the static files.
+func AttachSite(r *mux.Router) {
 	l := r.Path("/login").Subrouter()
 	l.Methods("GET").HandlerFunc(myHandler(GetLogin))
 	l.Methods("POST").HandlerFunc(myHandler(PostLogin))
-	r.Path("/logout").Methods("GET").HandlerFunc(myHandler(GetLogout))
+	r.Path("/logout").Methods("POST").HandlerFunc(myHandler(PostLogout))
+
+	s := r.Path("/signup").Subrouter()
+	s.Methods("GET").HandlerFunc(myHandler(GetSignup))
+	s.Methods("POST").HandlerFunc(myHandler(PostSignup))
+	r.HandleFunc("/verify", myHandler(GetVerify)).Methods("GET")
+	r.HandleFunc("/verify/resend", myHandler(PostVerifyResend)).Methods("POST")
+	pf := r.Path("/password/forgot").Subrouter()
+	pf.Methods("GET").HandlerFunc(myHandler(GetPasswordForgot))
+	pf.Methods("POST").HandlerFunc(myHandler(PostPasswordForgot))
+	pr := r.Path("/password/reset").Subrouter()
+	pr.Methods("GET").HandlerFunc(myHandler(GetPasswordReset))
+	pr.Methods("POST").HandlerFunc(myHandler(PostPasswordReset))
+	r.Path("/logout/all").Methods("POST").HandlerFunc(myHandler(PostLogoutAll))
 
 	p := r.Path("/profile/{account_name}").Subrouter()
 	p.Methods("GET").HandlerFunc(myHandler(GetProfile))
@@ -784,22 +953,50 @@ func main() {
 	d.HandleFunc("/entries/{account_name}", myHandler(ListEntries)).Methods("GET")
 	d.HandleFunc("/entry", myHandler(PostEntry)).Methods("POST")
 	d.HandleFunc("/entry/{entry_id}", myHandler(GetEntry)).Methods("GET")
+	d.HandleFunc("/entry/{entry_id}", myHandler(PostEntryEdit)).Methods("POST")
+	d.HandleFunc("/entry/{entry_id}/edit", myHandler(GetEntryEdit)).Methods("GET")
+	d.HandleFunc("/entry/{entry_id}/delete", myHandler(PostEntryDelete)).Methods("POST")
+	d.HandleFunc("/entry/{entry_id}/history", myHandler(GetEntryHistory)).Methods("GET")
+
+	d.HandleFunc("/entry/{entry_id}/lock", myHandler(PostEntryLock)).Methods("POST")
+	d.HandleFunc("/entry/{entry_id}/unlock", myHandler(PostEntryUnlock)).Methods("POST")
 
 	d.HandleFunc("/comment/{entry_id}", myHandler(PostComment)).Methods("POST")
+	d.HandleFunc("/comments/{comment_id}/delete", myHandler(PostCommentDelete)).Methods("POST")
+	d.HandleFunc("/comments/{comment_id}/hide", myHandler(PostCommentHide)).Methods("POST")
+	d.HandleFunc("/comments/{comment_id}/unhide", myHandler(PostCommentUnhide)).Methods("POST")
+
+	st := r.PathPrefix("/settings").Subrouter()
+	st.HandleFunc("", myHandler(GetSettings)).Methods("GET")
+	st.HandleFunc("/nick_name", myHandler(PostSettingsNickName)).Methods("POST")
+	st.HandleFunc("/account_name", myHandler(PostSettingsAccountName)).Methods("POST")
+	st.HandleFunc("/email", myHandler(PostSettingsEmail)).Methods("POST")
+	st.HandleFunc("/email/confirm", myHandler(GetSettingsEmailConfirm)).Methods("GET")
+	st.HandleFunc("/password", myHandler(PostSettingsPassword)).Methods("POST")
 
 	r.HandleFunc("/footprints", myHandler(GetFootprints)).Methods("GET")
 
 	r.HandleFunc("/friends", myHandler(GetFriends)).Methods("GET")
+	r.HandleFunc("/friends/requests", myHandler(GetFriendRequests)).Methods("GET")
+	r.HandleFunc("/friends/requests/{account_name}/accept", myHandler(PostFriendRequestAccept)).Methods("POST")
+	r.HandleFunc("/friends/requests/{account_name}/decline", myHandler(PostFriendRequestDecline)).Methods("POST")
+	r.HandleFunc("/friends/requests/{account_name}/cancel", myHandler(PostFriendRequestCancel)).Methods("POST")
 	r.HandleFunc("/friends/{account_name}", myHandler(PostFriends)).Methods("POST")
+	r.HandleFunc("/friends/{account_name}/unfriend", myHandler(PostUnfriend)).Methods("POST")
+
+	r.HandleFunc("/blocks", myHandler(GetBlocks)).Methods("GET")
+	r.HandleFunc("/blocks/{account_name}", myHandler(PostBlock)).Methods("POST")
+	r.HandleFunc("/blocks/{account_name}/delete", myHandler(PostUnblock)).Methods("POST")
+
+	AttachAPI(r)
 
-	r.HandleFunc("/initialize", myHandler(GetInitialize))
 	r.HandleFunc("/", myHandler(GetIndex))
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("../static")))
-	log.Fatal(http.ListenAndServe(":8080", r))
 }
 
-func checkErr(err error) {
-	if err != nil {
-		panic(err)
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return def
 }
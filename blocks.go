@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A block works both ways: neither user can see the other's profile,
+// entries or comments, comment on them, or befriend them. Blocking also ends
+// any friendship and pending friend request between the two, so isFriend and
+// permitted need no extra check.
+
+// Block is a user blocked by the current user.
+type Block struct {
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// checkNotBlocked denies access to anything of ownerID when the current
+// user and ownerID have blocked each other.
+func checkNotBlocked(w http.ResponseWriter, r *http.Request, ownerID int) error {
+	if ownerID == currentUser(r).ID {
+		return nil
+	}
+	blocked, err := reposFor(r).Blocks.Between(currentUser(r).ID, ownerID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+func blockUser(r *http.Request, user, another *User) error {
+	if user.ID == another.ID {
+		return ErrBadRequest
+	}
+	repos := reposFor(r)
+	if err := repos.Blocks.Create(user.ID, another.ID); err != nil {
+		return err
+	}
+	friendCache.Invalidate(user.ID, another.ID)
+	return repos.Timeline.DropBetween(user.ID, another.ID)
+}
+
+func GetBlocks(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	blocks, err := reposFor(r).Blocks.List(currentUser(r).ID)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		loaderFor(r).Users(b.UserID)
+	}
+	return render(w, r, http.StatusOK, "blocks.html", struct{ Blocks []Block }{blocks})
+}
+
+func PostBlock(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	another, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := blockUser(r, currentUser(r), another); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/blocks", http.StatusSeeOther)
+	return nil
+}
+
+func PostUnblock(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	another, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := reposFor(r).Blocks.Delete(currentUser(r).ID, another.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/blocks", http.StatusSeeOther)
+	return nil
+}
+
+func APIGetBlocks(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	blocks, err := reposFor(r).Blocks.List(user.ID)
+	if err != nil {
+		return err
+	}
+	res := make([]struct {
+		Block
+		User *PublicUser `json:"user"`
+	}, len(blocks))
+	l := loaderFor(r)
+	for _, b := range blocks {
+		l.Users(b.UserID)
+	}
+	for i, b := range blocks {
+		u, err := l.User(b.UserID)
+		if err != nil {
+			return err
+		}
+		res[i].Block = b
+		res[i].User = publicUser(u)
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
+
+func APIPostBlock(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	another, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := blockUser(r, user, another); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, publicUser(another))
+}
+
+func APIDeleteBlock(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	another, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := reposFor(r).Blocks.Delete(user.ID, another.ID); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
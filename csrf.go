@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"mime"
+	"net/http"
+)
+
+// csrfFieldName is the form field, and X-CSRF-Token the header, that carry
+// the token of the session.
+const csrfFieldName = "csrf_token"
+
+// csrfToken returns the CSRF token of the session, creating one on first
+// use. The token lives as long as the session and is replaced on login.
+// Only pages with a form ask for it, so a visitor who has not logged in has
+// no session until they are shown one.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	st := stateOf(r)
+	if st.csrfToken != "" {
+		return st.csrfToken, nil
+	}
+	session := getSession(w, r)
+	t, _ := session.Values["csrf_token"].(string)
+	if t == "" {
+		var err error
+		if t, err = newSessionToken(); err != nil {
+			return "", err
+		}
+		session.Values["csrf_token"] = t
+		if err := session.Save(r, w); err != nil {
+			return "", err
+		}
+	}
+	st.csrfToken = t
+	return t, nil
+}
+
+// csrfField is the hidden input every form of the templates includes.
+func csrfField(w http.ResponseWriter, r *http.Request) (template.HTML, error) {
+	t, err := csrfToken(w, r)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(`<input type="hidden" name="` + csrfFieldName + `" value="` + template.HTMLEscapeString(t) + `">`), nil
+}
+
+// verifyCSRF is run by serve before every handler. Requests that a page on
+// another site could not send without a CORS preflight, such as JSON bodies
+// or methods other than POST, need no token.
+func verifyCSRF(w http.ResponseWriter, r *http.Request) error {
+	if !crossSiteSendable(r) {
+		return nil
+	}
+	want, _ := getSession(w, r).Values["csrf_token"].(string)
+	got := r.Header.Get("X-CSRF-Token")
+	if got == "" {
+		got = r.PostFormValue(csrfFieldName)
+	}
+	if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return ErrCSRF
+	}
+	return nil
+}
+
+// crossSiteSendable reports whether a plain HTML form, or a no-cors fetch,
+// could have sent r. A POST without a Content-Type or with one that does
+// not parse counts as sendable. One with an Authorization header, such as
+// the admin token, does not.
+func crossSiteSendable(r *http.Request) bool {
+	if r.Method != "POST" || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return true
+	}
+	switch ct {
+	case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// Entries used to keep the title and the content in body, separated by the
+// first newline. They now have their own columns; body is still written so
+// that an older binary can read new entries, and rows written before the
+// columns existed are filled in by backfillEntries.
+
+// entryTitle is the title saved for title, which may have been left empty.
+func entryTitle(title string) string {
+	if title == "" {
+		return "タイトルなし"
+	}
+	return title
+}
+
+// entryBody packs title and content into entries.body.
+func entryBody(title, content string) string {
+	return title + "\n" + content
+}
+
+// splitEntryBody is the inverse of entryBody. A body without a newline is
+// all title.
+func splitEntryBody(body string) (string, string) {
+	i := strings.IndexByte(body, '\n')
+	if i < 0 {
+		return body, ""
+	}
+	return body[:i], body[i+1:]
+}
+
+// backfillEntries sets title and content of the entries which have none,
+// chunk rows at a time in ID order, each chunk in its own transaction. It
+// only touches rows whose title is NULL, so it can be stopped and run again
+// and continues where it left off; after is the ID to start after.
+func backfillEntries(q *DB, after, chunk int) error {
+	total := 0
+	for {
+		n, last, err := backfillEntryChunk(q, after, chunk)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			log.Printf("Backfilled %d entries.", total)
+			return nil
+		}
+		total += n
+		after = last
+		log.Printf("Backfilled %d entries, up to id %d.", total, last)
+	}
+}
+
+func backfillEntryChunk(q *DB, after, chunk int) (int, int, error) {
+	tx, err := q.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT id, body FROM entries WHERE id > ? AND title IS NULL ORDER BY id LIMIT ? FOR UPDATE`, after, chunk)
+	if err != nil {
+		return 0, 0, err
+	}
+	type row struct {
+		id   int
+		body string
+	}
+	pending := make([]row, 0, chunk)
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.body); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+	if len(pending) == 0 {
+		return 0, 0, nil
+	}
+	for _, r := range pending {
+		title, content := splitEntryBody(r.body)
+		if _, err := tx.Exec(`UPDATE entries SET title = ?, content = ? WHERE id = ?`, title, content, r.id); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(pending), pending[len(pending)-1].id, tx.Commit()
+}
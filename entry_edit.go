@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EntryRevision is a previous version of an entry, saved when it was edited.
+type EntryRevision struct {
+	ID        int       `json:"id"`
+	EntryID   int       `json:"entry_id"`
+	Private   bool      `json:"private"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ownEntry loads an entry of the current user for editing.
+func ownEntry(w http.ResponseWriter, r *http.Request, entryID string) (Entry, error) {
+	entry, err := entryParam(r, entryID)
+	if err != nil {
+		return Entry{}, err
+	}
+	if entry.UserID != currentUser(r).ID {
+		return Entry{}, ErrPermissionDenied
+	}
+	return entry, nil
+}
+
+// updateEntry keeps the current version of the entry as a revision and
+// overwrites it with the new one. It returns the ID of the entry, which
+// callers use instead of the raw entryID.
+func updateEntry(w http.ResponseWriter, r *http.Request, entryID string, title, content string, isPrivate bool) (int, error) {
+	id, err := strconv.Atoi(entryID)
+	if err != nil {
+		return 0, ErrContentNotFound
+	}
+	return id, reposFor(r).Entries.Update(id, currentUser(r).ID, entryTitle(title), content, isPrivate)
+}
+
+// deleteEntry soft-deletes the entry, which hides it and its comments.
+func deleteEntry(w http.ResponseWriter, r *http.Request, entryID string) error {
+	entry, err := ownEntry(w, r, entryID)
+	if err != nil {
+		return err
+	}
+	return reposFor(r).Entries.Delete(entry.ID)
+}
+
+// EntryHistoryData is an entry with its previous versions, newest first.
+type EntryHistoryData struct {
+	Owner     *User
+	Entry     Entry
+	Revisions []EntryRevision
+}
+
+// loadEntryHistory shows the history to whoever may read the entry.
+func loadEntryHistory(w http.ResponseWriter, r *http.Request, entryID string) (EntryHistoryData, error) {
+	entry, owner, err := readableEntry(w, r, entryID)
+	if err != nil {
+		return EntryHistoryData{}, err
+	}
+	revisions, err := reposFor(r).Entries.Revisions(entry.ID)
+	if err != nil {
+		return EntryHistoryData{}, err
+	}
+	ok, err := permitted(w, r, owner.ID)
+	if err != nil {
+		return EntryHistoryData{}, err
+	}
+	if !ok {
+		// an entry may have been private before
+		public := revisions[:0]
+		for _, rev := range revisions {
+			if !rev.Private {
+				public = append(public, rev)
+			}
+		}
+		revisions = public
+	}
+	return EntryHistoryData{owner, entry, revisions}, nil
+}
+
+func GetEntryEdit(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	entry, err := ownEntry(w, r, mux.Vars(r)["entry_id"])
+	if err != nil {
+		return err
+	}
+	return render(w, r, http.StatusOK, "entry_edit.html", struct{ Entry Entry }{entry})
+}
+
+func PostEntryEdit(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	id, err := updateEntry(w, r, mux.Vars(r)["entry_id"], r.FormValue("title"), r.FormValue("content"), r.FormValue("private") != "")
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(id), http.StatusSeeOther)
+	return nil
+}
+
+func PostEntryDelete(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	if err := deleteEntry(w, r, mux.Vars(r)["entry_id"]); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/diary/entries/"+currentUser(r).AccountName, http.StatusSeeOther)
+	return nil
+}
+
+func GetEntryHistory(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	d, err := loadEntryHistory(w, r, mux.Vars(r)["entry_id"])
+	if err != nil {
+		return err
+	}
+	return render(w, r, http.StatusOK, "entry_history.html", d)
+}
+
+func APIPutEntry(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	var req struct {
+		Title   string `json:"title"`
+		Content string `json:"content"`
+		Private bool   `json:"private"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+	id, err := updateEntry(w, r, mux.Vars(r)["entry_id"], req.Title, req.Content, req.Private)
+	if err != nil {
+		return err
+	}
+	return writeAPIEntry(w, r, http.StatusOK, strconv.Itoa(id), PageRequest{Limit: 50})
+}
+
+func APIDeleteEntry(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	if err := deleteEntry(w, r, mux.Vars(r)["entry_id"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func APIGetEntryRevisions(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	d, err := loadEntryHistory(w, r, mux.Vars(r)["entry_id"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Entry     Entry           `json:"entry"`
+		Revisions []EntryRevision `json:"revisions"`
+	}{d.Entry, d.Revisions})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// AppError is an error with the HTTP status and the message shown to the
+// user. Cause is the underlying error; it is logged but never sent to the
+// client.
+type AppError struct {
+	Status  int
+	Code    string
+	Message string
+	Cause   error
+}
+
+func (e *AppError) Error() string {
+	if e.Cause != nil {
+		return e.Code + ": " + e.Cause.Error()
+	}
+	return e.Code
+}
+
+var (
+	ErrAuthentication       = &AppError{http.StatusUnauthorized, "authentication_failed", "ログインに失敗しました", nil}
+	ErrPermissionDenied     = &AppError{http.StatusForbidden, "permission_denied", "友人のみしかアクセスできません", nil}
+	ErrContentNotFound      = &AppError{http.StatusNotFound, "not_found", "要求されたコンテンツは存在しません", nil}
+	ErrBadRequest           = &AppError{http.StatusBadRequest, "bad_request", "リクエストが不正です", nil}
+	ErrTooManyLogins        = &AppError{http.StatusTooManyRequests, "too_many_attempts", "ログインの試行が多すぎます。しばらくしてからやり直してください", nil}
+	ErrTooManyMails         = &AppError{http.StatusTooManyRequests, "too_many_attempts", "メールの送信が多すぎます。しばらくしてからやり直してください", nil}
+	ErrAccountLocked        = &AppError{http.StatusTooManyRequests, "account_locked", "ログインの失敗が続いたため、アカウントを一時的にロックしています", nil}
+	ErrEmailNotVerified     = &AppError{http.StatusForbidden, "email_not_verified", "メールアドレスの確認が済んでいません。確認メールのURLを開いてください", nil}
+	ErrAccountNameTaken     = &AppError{http.StatusConflict, "account_name_taken", "そのアカウント名は既に使われています", nil}
+	ErrEmailTaken           = &AppError{http.StatusConflict, "email_taken", "そのメールアドレスは既に使われています", nil}
+	ErrWrongPassword        = &AppError{http.StatusForbidden, "wrong_password", "現在のパスワードが正しくありません", nil}
+	ErrInvalidToken         = &AppError{http.StatusBadRequest, "invalid_token", "URLが無効か、有効期限が切れています", nil}
+	ErrInvalidProfile       = &AppError{http.StatusBadRequest, "invalid_profile", "プロフィールの入力内容が正しくありません", nil}
+	ErrCSRF                 = &AppError{http.StatusForbidden, "csrf_failed", "ページの有効期限が切れました。もう一度やり直してください", nil}
+	ErrUnsupportedMediaType = &AppError{http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type: application/json で送ってください", nil}
+)
+
+// asAppError passes an *AppError through and turns anything else into an
+// internal error.
+func asAppError(err error) *AppError {
+	if e, ok := err.(*AppError); ok {
+		return e
+	}
+	return &AppError{http.StatusInternalServerError, "internal_error", "サーバでエラーが発生しました", err}
+}
+
+// appHandler is a handler which returns its failure instead of writing it.
+type appHandler func(http.ResponseWriter, *http.Request) error
+
+// myHandler serves an HTML page; errors are rendered as HTML or JSON
+// depending on the request.
+func myHandler(fn appHandler) http.HandlerFunc {
+	return serve(fn, false)
+}
+
+// apiHandler serves the JSON API; errors are always rendered as JSON.
+func apiHandler(fn appHandler) http.HandlerFunc {
+	return serve(fn, true)
+}
+
+func serve(fn appHandler, api bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		withID, st := withState(r)
+		if withID != r {
+			// Not behind accessLog.
+			r = withID
+			w.Header().Set("X-Request-Id", st.id)
+		}
+		id := st.id
+		defer func() {
+			if rcv := recover(); rcv != nil {
+				logEvent("panic", "request_id", id, "method", r.Method, "path", r.URL.Path, "error", fmt.Sprint(rcv), "stack", string(debug.Stack()))
+				writeError(w, r, api, asAppError(fmt.Errorf("panic: %v", rcv)))
+			}
+		}()
+		err := verifyCSRF(w, r)
+		if err == nil {
+			err = fn(w, r)
+		}
+		if err != nil {
+			e := asAppError(err)
+			if e.Cause != nil {
+				logEvent("error", "request_id", id, "method", r.Method, "path", r.URL.Path, "code", e.Code, "error", e.Cause.Error())
+			}
+			writeError(w, r, api || wantsJSON(r), e)
+		}
+	}
+}
+
+// wantsJSON reports whether the client prefers JSON to HTML.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, asJSON bool, e *AppError) {
+	if e == ErrAuthentication {
+		if session := getSession(w, r); session != nil && !session.IsNew {
+			delete(session.Values, "user_id")
+			session.Save(r, w)
+		}
+	}
+	var id string
+	if e.Status >= http.StatusInternalServerError {
+		id = requestID(r)
+	}
+	if asJSON {
+		writeAPIError(w, e.Status, APIError{Code: e.Code, Message: e.Message, RequestID: id})
+		return
+	}
+	file := "error.html"
+	if e == ErrAuthentication || e == ErrTooManyLogins || e == ErrAccountLocked || e == ErrEmailNotVerified {
+		file = "login.html"
+	}
+	err := render(w, r, e.Status, file, struct {
+		Message   string
+		RequestID string
+	}{e.Message, id})
+	if err != nil {
+		logEvent("error", "request_id", requestID(r), "method", r.Method, "path", r.URL.Path, "code", "render_failed", "template", file, "error", err.Error())
+		http.Error(w, e.Message, e.Status)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "-"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestID is the ID under which errors of the request are logged.
+func requestID(r *http.Request) string {
+	return stateOf(r).id
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FriendCache keeps the friends of recently seen users in memory, so that
+// isFriend, which templates call once per listed user, does not hit
+// relations every time. Sets are loaded whole from relations on a miss and
+// dropped whenever a friendship of their user changes; the least recently
+// used sets are evicted once more than MaxEdges friendships are cached.
+//
+// The cache is per process. Running several app servers against one
+// database would need a shared invalidation channel.
+type FriendCache struct {
+	MaxEdges int
+
+	mu    sync.Mutex
+	sets  map[int]*list.Element
+	lru   *list.List
+	edges int
+	// gen is bumped by every invalidation, so that a set loaded while its
+	// user's friendships changed is not stored.
+	gen uint64
+
+	hits   uint64
+	misses uint64
+}
+
+type friendSet struct {
+	userID  int
+	friends map[int]time.Time
+}
+
+// FriendCacheStats is reported by the admin API.
+type FriendCacheStats struct {
+	Users   int     `json:"users"`
+	Edges   int     `json:"edges"`
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+var friendCache *FriendCache
+
+func NewFriendCache(maxEdges int) *FriendCache {
+	return &FriendCache{
+		MaxEdges: maxEdges,
+		sets:     make(map[int]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Friends returns the friends of userID with the time each friendship
+// started, loading them from relations on a miss. The map is shared and
+// must not be modified.
+func (c *FriendCache) Friends(relations RelationRepo, userID int) (map[int]time.Time, error) {
+	c.mu.Lock()
+	if el, ok := c.sets[userID]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return el.Value.(*friendSet).friends, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	friends, err := relations.FriendSet(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || c.MaxEdges <= 0 {
+		return friends, nil
+	}
+	if _, ok := c.sets[userID]; !ok {
+		c.sets[userID] = c.lru.PushFront(&friendSet{userID, friends})
+		c.edges += len(friends)
+		c.evict()
+	}
+	return friends, nil
+}
+
+func (c *FriendCache) IsFriend(relations RelationRepo, userID, anotherID int) (bool, error) {
+	friends, err := c.Friends(relations, userID)
+	if err != nil {
+		return false, err
+	}
+	_, ok := friends[anotherID]
+	return ok, nil
+}
+
+// Invalidate drops the cached friends of the given users.
+func (c *FriendCache) Invalidate(userIDs ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, id := range userIDs {
+		if el, ok := c.sets[id]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// Purge drops everything, for bulk changes such as /initialize.
+func (c *FriendCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.sets = make(map[int]*list.Element)
+	c.lru.Init()
+	c.edges = 0
+}
+
+func (c *FriendCache) Stats() FriendCacheStats {
+	c.mu.Lock()
+	st := FriendCacheStats{Users: len(c.sets), Edges: c.edges}
+	c.mu.Unlock()
+	st.Hits = atomic.LoadUint64(&c.hits)
+	st.Misses = atomic.LoadUint64(&c.misses)
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRate = float64(st.Hits) / float64(total)
+	}
+	return st
+}
+
+func (c *FriendCache) evict() {
+	for c.edges > c.MaxEdges && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *FriendCache) remove(el *list.Element) {
+	set := el.Value.(*friendSet)
+	c.lru.Remove(el)
+	delete(c.sets, set.userID)
+	c.edges -= len(set.friends)
+}
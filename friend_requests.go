@@ -0,0 +1,299 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Friendship needs the consent of both users: a request stays in
+// friend_requests until the addressee accepts or declines it, or the
+// requester cancels it. Only an accepted request creates relations rows.
+
+// FriendRequest is a pending request; UserID is the other party.
+type FriendRequest struct {
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Results of sendFriendRequest.
+const (
+	FriendRequested        = "requested"
+	FriendAccepted         = "accepted"
+	FriendAlreadyRequested = "already_requested"
+	FriendAlreadyFriends   = "already_friends"
+)
+
+// sendFriendRequest asks anotherAccount to become a friend of the current
+// user. If anotherAccount has already asked the current user, that request
+// is accepted instead.
+func sendFriendRequest(w http.ResponseWriter, r *http.Request, anotherAccount string) (string, error) {
+	user := currentUser(r)
+	another, err := reposFor(r).Users.ByAccountName(anotherAccount)
+	if err != nil {
+		return "", err
+	}
+	if another.ID == user.ID {
+		return "", ErrBadRequest
+	}
+	if err := checkNotBlocked(w, r, another.ID); err != nil {
+		return "", err
+	}
+	friend, err := isFriend(w, r, another.ID)
+	if err != nil {
+		return "", err
+	}
+	if friend {
+		return FriendAlreadyFriends, nil
+	}
+	pending, err := reposFor(r).FriendRequests.Pending(user.ID, another.ID)
+	if err != nil {
+		return "", err
+	}
+	switch pending {
+	case "incoming":
+		if err := acceptFriendRequest(r, user, another); err != nil {
+			return "", err
+		}
+		return FriendAccepted, nil
+	case "outgoing":
+		return FriendAlreadyRequested, nil
+	}
+	if err := reposFor(r).FriendRequests.Create(user.ID, another.ID); err != nil {
+		return "", err
+	}
+	return FriendRequested, nil
+}
+
+// acceptFriendRequest turns the request from requester to user into a
+// friendship.
+func acceptFriendRequest(r *http.Request, user, requester *User) error {
+	repos := reposFor(r)
+	blocked, err := repos.Blocks.Between(user.ID, requester.ID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrPermissionDenied
+	}
+	if err := repos.FriendRequests.Accept(requester.ID, user.ID); err != nil {
+		return err
+	}
+	friendCache.Invalidate(user.ID, requester.ID)
+	if err := repos.Timeline.Backfill(user.ID, requester.ID); err != nil {
+		return err
+	}
+	return repos.Timeline.Backfill(requester.ID, user.ID)
+}
+
+// unfriend ends the friendship of the two users.
+func unfriend(r *http.Request, userID, anotherID int) error {
+	repos := reposFor(r)
+	if err := repos.Relations.Delete(userID, anotherID); err != nil {
+		return err
+	}
+	friendCache.Invalidate(userID, anotherID)
+	return repos.Timeline.DropBetween(userID, anotherID)
+}
+
+func GetFriendRequests(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	user := currentUser(r)
+	incoming, err := reposFor(r).FriendRequests.List(user.ID, true)
+	if err != nil {
+		return err
+	}
+	outgoing, err := reposFor(r).FriendRequests.List(user.ID, false)
+	if err != nil {
+		return err
+	}
+	for _, fr := range incoming {
+		loaderFor(r).Users(fr.UserID)
+	}
+	for _, fr := range outgoing {
+		loaderFor(r).Users(fr.UserID)
+	}
+	return render(w, r, http.StatusOK, "friend_requests.html", struct {
+		Incoming []FriendRequest
+		Outgoing []FriendRequest
+	}{incoming, outgoing})
+}
+
+func PostFriendRequestAccept(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	requester, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := acceptFriendRequest(r, currentUser(r), requester); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
+}
+
+func PostFriendRequestDecline(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	requester, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := reposFor(r).FriendRequests.Delete(requester.ID, currentUser(r).ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends/requests", http.StatusSeeOther)
+	return nil
+}
+
+func PostFriendRequestCancel(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	addressee, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := reposFor(r).FriendRequests.Delete(currentUser(r).ID, addressee.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends/requests", http.StatusSeeOther)
+	return nil
+}
+
+func PostUnfriend(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	another, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := unfriend(r, currentUser(r).ID, another.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
+}
+
+func APIGetFriendRequests(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Incoming []APIFriendRequest `json:"incoming"`
+		Outgoing []APIFriendRequest `json:"outgoing"`
+	}
+	for _, incoming := range []bool{true, false} {
+		requests, err := reposFor(r).FriendRequests.List(user.ID, incoming)
+		if err != nil {
+			return err
+		}
+		list, err := apiFriendRequests(r, requests)
+		if err != nil {
+			return err
+		}
+		if incoming {
+			res.Incoming = list
+		} else {
+			res.Outgoing = list
+		}
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
+
+type APIFriendRequest struct {
+	FriendRequest
+	User *PublicUser `json:"user"`
+}
+
+func apiFriendRequests(r *http.Request, requests []FriendRequest) ([]APIFriendRequest, error) {
+	l := loaderFor(r)
+	for _, fr := range requests {
+		l.Users(fr.UserID)
+	}
+	res := make([]APIFriendRequest, 0, len(requests))
+	for _, fr := range requests {
+		u, err := l.User(fr.UserID)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, APIFriendRequest{fr, publicUser(u)})
+	}
+	return res, nil
+}
+
+func APIPostFriendRequestAccept(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	requester, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := acceptFriendRequest(r, user, requester); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, publicUser(requester))
+}
+
+func APIPostFriendRequestDecline(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	requester, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := reposFor(r).FriendRequests.Delete(requester.ID, user.ID); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func APIDeleteFriendRequest(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	addressee, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := reposFor(r).FriendRequests.Delete(user.ID, addressee.ID); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func APIDeleteFriend(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiCurrentUser(w, r)
+	if err != nil {
+		return err
+	}
+	another, err := reposFor(r).Users.ByAccountName(mux.Vars(r)["account_name"])
+	if err != nil {
+		return err
+	}
+	if err := unfriend(r, user.ID, another.ID); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
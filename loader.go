@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Loader fetches the users and entries a page refers to in batches. Page
+// loaders queue the IDs they will need with Users and Entries; the first
+// lookup of any of them fetches everything queued so far with a single call
+// of UserRepo.ByIDs or EntryRepo.ByIDs. Results are cached until the request
+// ends.
+//
+// A Loader is bound to one request and is not safe for concurrent use.
+type Loader struct {
+	repos   Repos
+	users   map[int]*User
+	entries map[int]Entry
+
+	pendingUsers   []int
+	pendingEntries []int
+}
+
+// loaderFor returns the Loader of the request, creating it on first use.
+func loaderFor(r *http.Request) *Loader {
+	st := stateOf(r)
+	if st.loader == nil {
+		st.loader = &Loader{repos: reposFor(r), users: make(map[int]*User), entries: make(map[int]Entry)}
+	}
+	return st.loader
+}
+
+// Users queues user IDs to be fetched with the next batch.
+func (l *Loader) Users(ids ...int) {
+	for _, id := range ids {
+		if _, ok := l.users[id]; !ok {
+			l.pendingUsers = append(l.pendingUsers, id)
+		}
+	}
+}
+
+// Entries queues entry IDs to be fetched with the next batch. The owners of
+// the entries are queued once the entries have been fetched.
+func (l *Loader) Entries(ids ...int) {
+	for _, id := range ids {
+		if _, ok := l.entries[id]; !ok {
+			l.pendingEntries = append(l.pendingEntries, id)
+		}
+	}
+}
+
+func (l *Loader) User(id int) (*User, error) {
+	if u, ok := l.users[id]; ok {
+		return u, nil
+	}
+	l.Users(id)
+	if err := l.fetchUsers(); err != nil {
+		return nil, err
+	}
+	u, ok := l.users[id]
+	if !ok {
+		return nil, ErrContentNotFound
+	}
+	return u, nil
+}
+
+func (l *Loader) Entry(id int) (Entry, error) {
+	if e, ok := l.entries[id]; ok {
+		return e, nil
+	}
+	l.Entries(id)
+	if err := l.fetchEntries(); err != nil {
+		return Entry{}, err
+	}
+	e, ok := l.entries[id]
+	if !ok {
+		return Entry{}, ErrContentNotFound
+	}
+	return e, nil
+}
+
+func (l *Loader) fetchUsers() error {
+	ids := l.pendingUsers
+	l.pendingUsers = nil
+	if len(ids) == 0 {
+		return nil
+	}
+	users, err := l.repos.Users.ByIDs(ids)
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		l.users[users[i].ID] = &users[i]
+	}
+	return nil
+}
+
+func (l *Loader) fetchEntries() error {
+	ids := l.pendingEntries
+	l.pendingEntries = nil
+	if len(ids) == 0 {
+		return nil
+	}
+	entries, err := l.repos.Entries.ByIDs(ids)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		l.entries[entry.ID] = entry
+		l.Users(entry.UserID)
+	}
+	return nil
+}
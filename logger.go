@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// logFormat is "logfmt" (the default) or "json", from ISUCON5_LOG_FORMAT.
+var logFormat = "logfmt"
+
+var eventLog = log.New(os.Stderr, "", 0)
+
+// logEvent writes one structured log line. kv holds alternating keys and
+// values; keys keep their order in logfmt.
+func logEvent(msg string, kv ...interface{}) {
+	if logFormat == "json" {
+		m := make(map[string]interface{}, len(kv)/2+2)
+		m["time"] = time.Now().Format(time.RFC3339Nano)
+		m["msg"] = msg
+		for i := 0; i+1 < len(kv); i += 2 {
+			m[fmt.Sprint(kv[i])] = kv[i+1]
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			eventLog.Printf("msg=log_error error=%q", err.Error())
+			return
+		}
+		eventLog.Print(string(b))
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString("time=" + time.Now().Format(time.RFC3339Nano) + " msg=" + logfmtValue(msg))
+	for i := 0; i+1 < len(kv); i += 2 {
+		buf.WriteString(" " + fmt.Sprint(kv[i]) + "=" + logfmtValue(fmt.Sprint(kv[i+1])))
+	}
+	eventLog.Print(buf.String())
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// statusWriter remembers the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// accessLog gives every request its requestState, and so its ID, and logs
+// it once it is served.
+func accessLog(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, state := withState(r)
+		w.Header().Set("X-Request-Id", state.id)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		router.ServeHTTP(sw, r)
+
+		route := routeTemplate(router, r)
+		elapsed := time.Since(start)
+		var userID interface{} = "-"
+		if state.user != nil {
+			userID = state.user.ID
+		}
+		st := &state.queries
+		logEvent("access",
+			"request_id", state.id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration_ms", millis(elapsed),
+			"user_id", userID,
+			"queries", st.Count(),
+			"sql_ms", millis(st.Duration()),
+		)
+		metrics.ObserveRequest(route, r.Method, sw.status, elapsed, st.Count())
+	})
+}
+
+// routeTemplate is the path template of the matching route, such as
+// "/diary/entry/{entry_id}", so that requests group by handler.
+func routeTemplate(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if !router.Match(r, &match) || match.Route == nil {
+		return "-"
+	}
+	tpl, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return "-"
+	}
+	return tpl
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginLimiter slows down repeated failed logins per e-mail address and per
+// client address. Each key gets a few free failures, after which every
+// further failure doubles the time the key has to wait before the next try.
+// State is in memory only; lockout of accounts is in login_attempts.
+type LoginLimiter struct {
+	EmailFree int
+	IPFree    int
+	Base      time.Duration
+	Max       time.Duration
+
+	mu   sync.Mutex
+	keys map[string]*loginBackoff
+}
+
+type loginBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// Account lockout, from ISUCON5_LOGIN_LOCKOUT_THRESHOLD and
+// ISUCON5_LOGIN_LOCKOUT: an account with this many consecutive failures is
+// refused until the lockout has passed since the last of them.
+var (
+	lockoutThreshold = 10
+	lockoutDuration  = 15 * time.Minute
+)
+
+var loginLimiter = NewLoginLimiter()
+
+// mailLimiter counts the requests to mail an address, for signup and
+// password reset. It is apart from loginLimiter, so that asking for mails
+// to an address does not slow down logins to it.
+var mailLimiter = NewLoginLimiter()
+
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		EmailFree: 3,
+		IPFree:    20,
+		Base:      time.Second,
+		Max:       5 * time.Minute,
+		keys:      make(map[string]*loginBackoff),
+	}
+}
+
+// Wait returns how long the caller must wait before trying again, or 0.
+func (l *LoginLimiter) Wait(email, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range []string{"email:" + strings.ToLower(email), "ip:" + ip} {
+		if b, ok := l.keys[k]; ok && b.until.After(now) && b.until.Sub(now) > wait {
+			wait = b.until.Sub(now)
+		}
+	}
+	return wait
+}
+
+func (l *LoginLimiter) Fail(email, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fail("email:"+strings.ToLower(email), l.EmailFree)
+	l.fail("ip:"+ip, l.IPFree)
+}
+
+func (l *LoginLimiter) fail(key string, free int) {
+	b, ok := l.keys[key]
+	if !ok {
+		b = &loginBackoff{}
+		l.keys[key] = b
+	}
+	b.failures++
+	if n := b.failures - free; n > 0 {
+		d := time.Duration(float64(l.Base) * math.Pow(2, float64(n-1)))
+		if d > l.Max || d <= 0 {
+			d = l.Max
+		}
+		b.until = time.Now().Add(d)
+	}
+}
+
+// Succeed clears the address of the account. The client address is kept,
+// so that logging in to one's own account does not reset the limit on
+// guessing others.
+func (l *LoginLimiter) Succeed(email string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, "email:"+strings.ToLower(email))
+}
+
+// Purge forgets every key, for /initialize.
+func (l *LoginLimiter) Purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.keys = make(map[string]*loginBackoff)
+}
+
+// GC forgets keys idle for longer than Max every interval until the process
+// exits.
+func (l *LoginLimiter) GC(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mu.Lock()
+		now := time.Now()
+		for k, b := range l.keys {
+			if now.Sub(b.until) > l.Max {
+				delete(l.keys, k)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// remoteIP is the address the connection came from, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func retryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+type LoginAttempt struct {
+	RemoteAddr string    `json:"remote_addr"`
+	CreatedAt  time.Time `json:"created_at"`
+	Succeeded  bool      `json:"-"`
+}
+
+// accountLockedFor returns how much longer logins with the email address
+// stay locked, or 0. The lockout goes by the address rather than the
+// account, so that an address without an account locks the same way and
+// the answer does not tell whether it has one. Failures up to a password
+// reset do not count.
+func accountLockedFor(logins LoginRepo, email string) (time.Duration, error) {
+	if lockoutThreshold <= 0 {
+		return 0, nil
+	}
+	attempts, err := logins.Recent(email, lockoutThreshold)
+	if err != nil {
+		return 0, err
+	}
+	if len(attempts) < lockoutThreshold {
+		return 0, nil
+	}
+	reset, err := logins.LockoutReset(email)
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range attempts {
+		if a.Succeeded || !a.CreatedAt.After(reset) {
+			return 0, nil
+		}
+	}
+	if d := attempts[0].CreatedAt.Add(lockoutDuration).Sub(time.Now()); d > 0 {
+		return d, nil
+	}
+	return 0, nil
+}
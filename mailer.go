@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers the mails of signup and password reset. It is chosen with
+// ISUCON5_MAILER.
+type Mailer interface {
+	Send(m Mail) error
+}
+
+var mailer Mailer = &WriterMailer{W: os.Stdout}
+
+// mailFrom and baseURL are used in every mail, from ISUCON5_MAIL_FROM and
+// ISUCON5_BASE_URL.
+var (
+	mailFrom = "isuxi@localhost"
+	baseURL  = "http://localhost:8080"
+)
+
+func (m Mail) bytes() []byte {
+	var buf bytes.Buffer
+	subject := mime.BEncoding.Encode("UTF-8", m.Subject)
+	fmt.Fprintf(&buf, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", mailFrom, m.To, subject, time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(m.Body)
+	return buf.Bytes()
+}
+
+// WriterMailer prints mails instead of sending them, for local testing.
+type WriterMailer struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+func (wm *WriterMailer) Send(m Mail) error {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	_, err := wm.W.Write(append(m.bytes(), "\r\n.\r\n"...))
+	return err
+}
+
+// FileMailer writes each mail to its own file in Dir.
+type FileMailer struct {
+	Dir string
+}
+
+func (fm *FileMailer) Send(m Mail) error {
+	token, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + token[:8] + ".eml"
+	return ioutil.WriteFile(filepath.Join(fm.Dir, name), m.bytes(), 0600)
+}
+
+// SMTPMailer relays through an SMTP server without authentication, such as
+// a local MTA.
+type SMTPMailer struct {
+	Addr string
+}
+
+func (sm *SMTPMailer) Send(m Mail) error {
+	return smtp.SendMail(sm.Addr, nil, mailFrom, []string{m.To}, m.bytes())
+}
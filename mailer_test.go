@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"testing"
+)
+
+func TestMailHeaders(t *testing.T) {
+	m := Mail{To: "alice@example.com", Subject: "パスワードの再設定", Body: "本文\r\n"}
+	msg, err := mail.ReadMessage(bytes.NewReader(m.bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []byte(msg.Header["Subject"][0]) {
+		if b >= 0x80 {
+			t.Fatalf("raw UTF-8 in the subject header: %q", msg.Header["Subject"][0])
+		}
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != m.Subject {
+		t.Errorf("subject decodes to %q, %v; want %q", subject, err, m.Subject)
+	}
+	if got := msg.Header.Get("Content-Type"); got != "text/plain; charset=UTF-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
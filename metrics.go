@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects what /metrics reports in the Prometheus text format.
+// Series are keyed by the route template, never by the raw path, so that
+// the number of series stays bounded.
+type Metrics struct {
+	// DB is the connection pool whose stats are reported, if any.
+	DB *sql.DB
+
+	mu        sync.Mutex
+	requests  map[string]uint64 // route, method, status
+	durations map[string]*histogram
+	queries   map[string]*histogram
+	renders   map[string]*histogram
+}
+
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	queryBuckets    = []float64{0, 1, 2, 5, 10, 20, 50, 100, 200}
+)
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[string]uint64),
+		durations: make(map[string]*histogram),
+		queries:   make(map[string]*histogram),
+		renders:   make(map[string]*histogram),
+	}
+}
+
+// ObserveRequest is called by accessLog once a request is served.
+func (m *Metrics) ObserveRequest(route, method string, status int, d time.Duration, queries int64) {
+	method = methodLabel(method)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[labels("route", route, "method", method, "status", strconv.Itoa(status))]++
+	observe(m.durations, labels("route", route, "method", method), durationBuckets, d.Seconds())
+	observe(m.queries, labels("route", route), queryBuckets, float64(queries))
+}
+
+// ObserveRender is called by render for every page executed.
+func (m *Metrics) ObserveRender(file string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observe(m.renders, labels("template", file), durationBuckets, d.Seconds())
+}
+
+func (m *Metrics) WriteTo(buf *bytes.Buffer) {
+	m.mu.Lock()
+	writeHeader(buf, "isucon5_http_requests_total", "counter", "Requests served, by route template, method and status.")
+	for _, k := range sortedKeys(m.requests) {
+		fmt.Fprintf(buf, "isucon5_http_requests_total{%s} %d\n", k, m.requests[k])
+	}
+	writeHistograms(buf, "isucon5_http_request_duration_seconds", "Time to serve a request.", m.durations)
+	writeHistograms(buf, "isucon5_http_request_queries", "SQL queries run by a request.", m.queries)
+	writeHistograms(buf, "isucon5_template_render_duration_seconds", "Time to execute a page template.", m.renders)
+	m.mu.Unlock()
+
+	if m.DB != nil {
+		st := m.DB.Stats()
+		writeHeader(buf, "isucon5_db_open_connections", "gauge", "Open connections to the database.")
+		fmt.Fprintf(buf, "isucon5_db_open_connections %d\n", st.OpenConnections)
+		writeHeader(buf, "isucon5_db_in_use_connections", "gauge", "Connections running a query or transaction.")
+		fmt.Fprintf(buf, "isucon5_db_in_use_connections %d\n", st.InUse)
+		writeHeader(buf, "isucon5_db_idle_connections", "gauge", "Connections idle in the pool.")
+		fmt.Fprintf(buf, "isucon5_db_idle_connections %d\n", st.Idle)
+		writeHeader(buf, "isucon5_db_wait_count_total", "counter", "Queries which had to wait for a free connection.")
+		fmt.Fprintf(buf, "isucon5_db_wait_count_total %d\n", st.WaitCount)
+		writeHeader(buf, "isucon5_db_wait_duration_seconds_total", "counter", "Time spent waiting for a free connection.")
+		fmt.Fprintf(buf, "isucon5_db_wait_duration_seconds_total %s\n", formatFloat(st.WaitDuration.Seconds()))
+	}
+
+	fc := friendCache.Stats()
+	writeHeader(buf, "isucon5_friend_cache_hits_total", "counter", "Friend set lookups served from memory.")
+	fmt.Fprintf(buf, "isucon5_friend_cache_hits_total %d\n", fc.Hits)
+	writeHeader(buf, "isucon5_friend_cache_misses_total", "counter", "Friend set lookups loaded from relations.")
+	fmt.Fprintf(buf, "isucon5_friend_cache_misses_total %d\n", fc.Misses)
+	writeHeader(buf, "isucon5_friend_cache_hit_ratio", "gauge", "Share of friend set lookups served from memory.")
+	fmt.Fprintf(buf, "isucon5_friend_cache_hit_ratio %s\n", formatFloat(fc.HitRate))
+	writeHeader(buf, "isucon5_friend_cache_users", "gauge", "Users whose friends are cached.")
+	fmt.Fprintf(buf, "isucon5_friend_cache_users %d\n", fc.Users)
+	writeHeader(buf, "isucon5_friend_cache_edges", "gauge", "Friendships cached.")
+	fmt.Fprintf(buf, "isucon5_friend_cache_edges %d\n", fc.Edges)
+}
+
+func GetMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf.WriteTo(w)
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // counts[i] observations <= buckets[i]
+	count   uint64
+	sum     float64
+}
+
+func observe(hs map[string]*histogram, key string, buckets []float64, v float64) {
+	h, ok := hs[key]
+	if !ok {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		hs[key] = h
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func writeHistograms(buf *bytes.Buffer, name, help string, hs map[string]*histogram) {
+	writeHeader(buf, name, "histogram", help)
+	keys := make([]string, 0, len(hs))
+	for k := range hs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := hs[k]
+		for i, le := range h.buckets {
+			fmt.Fprintf(buf, "%s_bucket{%s,le=\"%s\"} %d\n", name, k, formatFloat(le), h.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, k, h.count)
+		fmt.Fprintf(buf, "%s_sum{%s} %s\n", name, k, formatFloat(h.sum))
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", name, k, h.count)
+	}
+}
+
+// knownMethods are reported by name. Clients may send any token as the
+// method, so everything else is "OTHER" to keep the series bounded.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+func writeHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labels renders name/value pairs as `a="1",b="2"`, which is also the key
+// of the series.
+func labels(kv ...string) string {
+	parts := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		parts = append(parts, kv[i]+`="`+labelEscaper.Replace(kv[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsMethodLabel(t *testing.T) {
+	friendCache = NewFriendCache(10)
+	m := NewMetrics()
+	m.ObserveRequest("/", "GET", 200, time.Millisecond, 1)
+	m.ObserveRequest("/", "BREW", 405, time.Millisecond, 0)
+	m.ObserveRequest("/", "PROPFIND", 405, time.Millisecond, 0)
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`isucon5_http_requests_total{route="/",method="GET",status="200"} 1`,
+		`isucon5_http_requests_total{route="/",method="OTHER",status="405"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "BREW") {
+		t.Errorf("unknown method is a label value:\n%s", out)
+	}
+}
+
+func TestMetricsDBStats(t *testing.T) {
+	conn, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	friendCache = NewFriendCache(10)
+	m := NewMetrics()
+	m.DB = conn
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	for _, want := range []string{
+		"isucon5_db_open_connections 0",
+		"isucon5_db_in_use_connections 0",
+		"isucon5_db_idle_connections 0",
+		"isucon5_db_wait_count_total 0",
+		"isucon5_db_wait_duration_seconds_total 0",
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("missing %s in\n%s", want, buf.String())
+		}
+	}
+}
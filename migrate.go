@@ -0,0 +1,537 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Migration is one numbered change of the schema. Statements are run one at
+// a time and not in a transaction, since MySQL commits DDL implicitly. Each
+// statement that succeeds is recorded in schema_migration_steps, so that a
+// migration which fails halfway resumes after its last successful statement
+// when it is run again.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// migrations are applied in order. Append new ones at the end and never
+// change one that has been released.
+var migrations = []Migration{
+	{1, "base", []string{
+		`CREATE TABLE IF NOT EXISTS users (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  account_name varchar(64) NOT NULL UNIQUE,
+  nick_name varchar(32) NOT NULL,
+  email varchar(255) CHARACTER SET utf8mb4 NOT NULL UNIQUE,
+  passhash varchar(128) NOT NULL
+) DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS salts (
+  user_id int NOT NULL PRIMARY KEY,
+  salt varchar(6)
+) DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS relations (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  one int NOT NULL,
+  another int NOT NULL,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY friendship (one, another)
+) DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS profiles (
+  user_id int NOT NULL PRIMARY KEY,
+  first_name varchar(64) NOT NULL,
+  last_name varchar(64) NOT NULL,
+  sex varchar(4) NOT NULL,
+  birthday date NOT NULL,
+  pref varchar(4) NOT NULL,
+  updated_at timestamp DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS entries (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id int NOT NULL,
+  private tinyint NOT NULL,
+  body text,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+  KEY user_id (user_id, created_at),
+  KEY created_at (created_at)
+) DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS comments (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  entry_id int NOT NULL,
+  user_id int NOT NULL,
+  comment text,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+  KEY entry_id (entry_id),
+  KEY created_at (created_at)
+) DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS footprints (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id int NOT NULL,
+  owner_id int NOT NULL,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS footprints`,
+		`DROP TABLE IF EXISTS comments`,
+		`DROP TABLE IF EXISTS entries`,
+		`DROP TABLE IF EXISTS profiles`,
+		`DROP TABLE IF EXISTS relations`,
+		`DROP TABLE IF EXISTS salts`,
+		`DROP TABLE IF EXISTS users`,
+	}},
+	{2, "sessions", []string{
+		`CREATE TABLE IF NOT EXISTS sessions (
+  id char(64) NOT NULL PRIMARY KEY,
+  user_id int NOT NULL DEFAULT 0,
+  data blob NOT NULL,
+  user_agent varchar(255) NOT NULL DEFAULT '',
+  remote_addr varchar(64) NOT NULL DEFAULT '',
+  created_at datetime NOT NULL,
+  last_seen_at datetime NOT NULL,
+  KEY user_id (user_id),
+  KEY last_seen_at (last_seen_at)
+) DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS sessions`,
+	}},
+	{3, "entry_revisions", []string{
+		`ALTER TABLE entries ADD COLUMN deleted_at datetime DEFAULT NULL`,
+		`CREATE TABLE IF NOT EXISTS entry_revisions (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  entry_id int NOT NULL,
+  private tinyint NOT NULL,
+  title text NOT NULL,
+  content text NOT NULL,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+  KEY entry_id (entry_id, id)
+) DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS entry_revisions`,
+		`ALTER TABLE entries DROP COLUMN deleted_at`,
+	}},
+	{4, "comment_moderation", []string{
+		`ALTER TABLE comments ADD COLUMN hidden tinyint NOT NULL DEFAULT 0, ADD COLUMN deleted_at datetime DEFAULT NULL`,
+		`ALTER TABLE entries ADD COLUMN comments_locked tinyint NOT NULL DEFAULT 0`,
+	}, []string{
+		`ALTER TABLE entries DROP COLUMN comments_locked`,
+		`ALTER TABLE comments DROP COLUMN deleted_at, DROP COLUMN hidden`,
+	}},
+	{5, "friend_requests", []string{
+		`CREATE TABLE IF NOT EXISTS friend_requests (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  requester_id int NOT NULL,
+  addressee_id int NOT NULL,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY requester_addressee (requester_id, addressee_id),
+  KEY addressee_id (addressee_id, created_at)
+) DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS friend_requests`,
+	}},
+	{6, "blocks", []string{
+		`CREATE TABLE IF NOT EXISTS blocks (
+  blocker_id int NOT NULL,
+  blocked_id int NOT NULL,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (blocker_id, blocked_id),
+  KEY blocked_id (blocked_id)
+) DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS blocks`,
+	}},
+	{7, "timeline", []string{
+		`CREATE TABLE IF NOT EXISTS timeline (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id int NOT NULL,
+  kind tinyint NOT NULL,
+  entry_id int NOT NULL,
+  comment_id int NOT NULL DEFAULT 0,
+  author_id int NOT NULL,
+  created_at timestamp NOT NULL,
+  UNIQUE KEY item (user_id, kind, entry_id, comment_id),
+  KEY feed (user_id, kind, created_at),
+  KEY author (user_id, author_id)
+) DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS timeline`,
+	}},
+	{8, "login_attempts", []string{
+		`CREATE TABLE IF NOT EXISTS login_attempts (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id int DEFAULT NULL,
+  email varchar(255) NOT NULL,
+  remote_addr varchar(64) NOT NULL,
+  succeeded tinyint(1) NOT NULL,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+  KEY user_id (user_id, id),
+  KEY email (email, created_at)
+) DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS login_attempts`,
+	}},
+	// Down keeps birthday nullable and salts wide, since rows written in
+	// the meantime may depend on it.
+	{9, "signup", []string{
+		`CREATE TABLE IF NOT EXISTS email_verifications (
+  user_id int NOT NULL PRIMARY KEY,
+  email varchar(255) NOT NULL,
+  verified_at datetime DEFAULT NULL,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS user_tokens (
+  token_hash char(64) NOT NULL PRIMARY KEY,
+  user_id int NOT NULL,
+  purpose varchar(32) NOT NULL,
+  email varchar(255) NOT NULL,
+  expires_at datetime NOT NULL,
+  used_at datetime DEFAULT NULL,
+  created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+  KEY user_id (user_id, purpose)
+) DEFAULT CHARSET=utf8mb4`,
+		`ALTER TABLE profiles MODIFY birthday date DEFAULT NULL`,
+		`ALTER TABLE salts MODIFY salt varchar(20)`,
+	}, []string{
+		`DROP TABLE IF EXISTS user_tokens`,
+		`DROP TABLE IF EXISTS email_verifications`,
+	}},
+	{10, "account_name_history", []string{
+		`CREATE TABLE IF NOT EXISTS account_name_history (
+  old_name varchar(64) NOT NULL PRIMARY KEY,
+  user_id int NOT NULL,
+  changed_at timestamp DEFAULT CURRENT_TIMESTAMP,
+  KEY user_id (user_id)
+) DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS account_name_history`,
+	}},
+	{11, "entry_columns", []string{
+		`ALTER TABLE entries ADD COLUMN title text DEFAULT NULL, ADD COLUMN content text DEFAULT NULL, ADD KEY title (title(191))`,
+	}, []string{
+		`ALTER TABLE entries DROP KEY title, DROP COLUMN content, DROP COLUMN title`,
+	}},
+	{12, "lockout_resets", []string{
+		`CREATE TABLE IF NOT EXISTS lockout_resets (
+  email varchar(255) NOT NULL PRIMARY KEY,
+  reset_at timestamp DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS lockout_resets`,
+	}},
+	// The users, profiles and relations of the initial data as they were
+	// when this is applied, for /initialize to put back. Users with an
+	// email verification signed up themselves.
+	{13, "initial_data", []string{
+		`CREATE TABLE IF NOT EXISTS initial_users (
+  id int NOT NULL PRIMARY KEY,
+  account_name varchar(64) NOT NULL,
+  nick_name varchar(32) NOT NULL,
+  email varchar(255) NOT NULL,
+  passhash varchar(128) NOT NULL
+) DEFAULT CHARSET=utf8mb4`,
+		`INSERT IGNORE INTO initial_users (id, account_name, nick_name, email, passhash)
+SELECT id, account_name, nick_name, email, passhash FROM users u
+WHERE NOT EXISTS (SELECT 1 FROM email_verifications v WHERE v.user_id = u.id)`,
+		`CREATE TABLE IF NOT EXISTS initial_profiles LIKE profiles`,
+		`INSERT IGNORE INTO initial_profiles SELECT p.* FROM profiles p JOIN initial_users i ON i.id = p.user_id`,
+		`CREATE TABLE IF NOT EXISTS initial_relations LIKE relations`,
+		`INSERT IGNORE INTO initial_relations SELECT * FROM relations WHERE id <= 500000`,
+	}, []string{
+		`DROP TABLE IF EXISTS initial_relations`,
+		`DROP TABLE IF EXISTS initial_profiles`,
+		`DROP TABLE IF EXISTS initial_users`,
+	}},
+}
+
+// schemaVersion is the version this binary expects.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func createSchemaMigrations(q *DB) error {
+	_, err := q.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+  version int NOT NULL PRIMARY KEY,
+  name varchar(255) NOT NULL,
+  applied_at timestamp DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`CREATE TABLE IF NOT EXISTS schema_migration_steps (
+  version int NOT NULL,
+  direction varchar(4) NOT NULL,
+  step int NOT NULL,
+  PRIMARY KEY (version, direction, step)
+) DEFAULT CHARSET=utf8mb4`)
+	return err
+}
+
+// completedSteps returns the statements of a migration in one direction
+// ("up" or "down") that have already succeeded, by index. A database
+// without schema_migration_steps has none.
+func completedSteps(q *DB, version int, direction string) (map[int]bool, error) {
+	rows, err := q.Query(`SELECT step FROM schema_migration_steps WHERE version = ? AND direction = ?`, version, direction)
+	if e, ok := err.(*mysql.MySQLError); ok && e.Number == 1146 {
+		return map[int]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	done := make(map[int]bool)
+	for rows.Next() {
+		var step int
+		if err := rows.Scan(&step); err != nil {
+			return nil, err
+		}
+		done[step] = true
+	}
+	return done, rows.Err()
+}
+
+// runSteps runs the statements of m in one direction, skipping those that
+// succeeded in an earlier run, and records each one as it succeeds.
+func runSteps(q *DB, m Migration, direction string, stmts []string) error {
+	done, err := completedSteps(q, m.Version, direction)
+	if err != nil {
+		return err
+	}
+	for i, stmt := range stmts {
+		if done[i] {
+			continue
+		}
+		if _, err := q.Exec(stmt); err != nil {
+			return fmt.Errorf("migration %d %s, statement %d of %d: %s", m.Version, m.Name, i+1, len(stmts), err)
+		}
+		if _, err := q.Exec(`INSERT INTO schema_migration_steps (version, direction, step) VALUES (?,?,?)`, m.Version, direction, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearSteps forgets the progress of a migration once it is recorded as
+// applied or reverted.
+func clearSteps(q *DB, version int) error {
+	_, err := q.Exec(`DELETE FROM schema_migration_steps WHERE version = ?`, version)
+	return err
+}
+
+// appliedMigrations returns when each version was applied. A database
+// without schema_migrations has none.
+func appliedMigrations(q *DB) (map[int]time.Time, error) {
+	rows, err := q.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if e, ok := err.(*mysql.MySQLError); ok && e.Number == 1146 {
+		return map[int]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		applied[v] = at
+	}
+	return applied, rows.Err()
+}
+
+// migrateUp applies every pending migration up to target.
+func migrateUp(q *DB, target int) error {
+	if err := createSchemaMigrations(q); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(q)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok || m.Version > target {
+			continue
+		}
+		if err := runSteps(q, m, "up", m.Up); err != nil {
+			return err
+		}
+		if _, err := q.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?,?)`, m.Version, m.Name); err != nil {
+			return err
+		}
+		if err := clearSteps(q, m.Version); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d %s.", m.Version, m.Name)
+	}
+	return nil
+}
+
+// migrateDown reverts the applied migrations above target, newest first.
+func migrateDown(q *DB, target int) error {
+	if err := createSchemaMigrations(q); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(q)
+	if err != nil {
+		return err
+	}
+	for v := range applied {
+		if v > schemaVersion() && v > target {
+			return fmt.Errorf("migration %d was applied by a newer binary", v)
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok || m.Version <= target {
+			continue
+		}
+		if err := runSteps(q, m, "down", m.Down); err != nil {
+			return err
+		}
+		if _, err := q.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version); err != nil {
+			return err
+		}
+		if err := clearSteps(q, m.Version); err != nil {
+			return err
+		}
+		log.Printf("Reverted migration %d %s.", m.Version, m.Name)
+	}
+	return nil
+}
+
+// migrateBaseline records the migrations up to target as applied without
+// running them, for databases set up before migrations existed.
+func migrateBaseline(q *DB, target int) error {
+	if err := createSchemaMigrations(q); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version > target {
+			break
+		}
+		if _, err := q.Exec(`INSERT IGNORE INTO schema_migrations (version, name) VALUES (?,?)`, m.Version, m.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateStatus(q *DB, w io.Writer) error {
+	applied, err := appliedMigrations(q)
+	if err != nil {
+		return err
+	}
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+		state := "pending"
+		if at, ok := applied[m.Version]; ok {
+			state = "applied " + at.Format("2006-01-02 15:04:05")
+			done, err := completedSteps(q, m.Version, "down")
+			if err != nil {
+				return err
+			}
+			if len(done) > 0 {
+				state = fmt.Sprintf("partly reverted (%d of %d statements)", len(done), len(m.Down))
+			}
+		} else {
+			done, err := completedSteps(q, m.Version, "up")
+			if err != nil {
+				return err
+			}
+			if len(done) > 0 {
+				state = fmt.Sprintf("partly applied (%d of %d statements)", len(done), len(m.Up))
+			}
+		}
+		fmt.Fprintf(w, "%4d %-24s %s\n", m.Version, m.Name, state)
+	}
+	unknown := make([]int, 0)
+	for v := range applied {
+		if !known[v] {
+			unknown = append(unknown, v)
+		}
+	}
+	sort.Ints(unknown)
+	for _, v := range unknown {
+		fmt.Fprintf(w, "%4d %-24s %s\n", v, "?", "applied by a newer binary")
+	}
+	return nil
+}
+
+// checkSchema refuses to serve on a database some migrations of this binary
+// have not been applied to.
+func checkSchema(q *DB) error {
+	applied, err := appliedMigrations(q)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			return fmt.Errorf("migration %d %s has not been applied; run `app migrate up`", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+var errMigrateUsage = errors.New("usage: app migrate up [version] | down [version] | status | baseline version")
+
+// runMigrate runs the migrate subcommand. down without a version reverts the
+// newest applied migration only.
+func runMigrate(q *DB, args []string, w io.Writer) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errMigrateUsage
+	}
+	target := -1
+	if len(args) == 2 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 {
+			return errMigrateUsage
+		}
+		target = v
+	}
+	switch args[0] {
+	case "up":
+		if target < 0 {
+			target = schemaVersion()
+		}
+		return migrateUp(q, target)
+	case "down":
+		if target < 0 {
+			applied, err := appliedMigrations(q)
+			if err != nil {
+				return err
+			}
+			latest := 0
+			for v := range applied {
+				if v > latest {
+					latest = v
+				}
+			}
+			if latest == 0 {
+				return nil
+			}
+			target = latest - 1
+		}
+		return migrateDown(q, target)
+	case "status":
+		if target >= 0 {
+			return errMigrateUsage
+		}
+		return migrateStatus(q, w)
+	case "baseline":
+		if target < 0 {
+			return errMigrateUsage
+		}
+		return migrateBaseline(q, target)
+	}
+	return errMigrateUsage
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Comment moderation: authors may delete their own comments, and entry
+// owners may delete or hide any comment on their entries and lock an entry
+// against new comments.
+
+// commentParam loads the comment named by a {comment_id} path variable,
+// unless it has been deleted.
+func commentParam(r *http.Request, commentID string) (Comment, error) {
+	id, err := strconv.Atoi(commentID)
+	if err != nil {
+		return Comment{}, ErrContentNotFound
+	}
+	return reposFor(r).Comments.Get(id)
+}
+
+// ownComment loads a comment on an entry of the current user.
+func ownComment(w http.ResponseWriter, r *http.Request, commentID string) (Comment, error) {
+	c, err := commentParam(r, commentID)
+	if err != nil {
+		return Comment{}, err
+	}
+	entry, err := reposFor(r).Entries.Get(c.EntryID)
+	if err != nil {
+		return Comment{}, err
+	}
+	if entry.UserID != currentUser(r).ID {
+		return Comment{}, ErrPermissionDenied
+	}
+	return c, nil
+}
+
+// deleteComment soft-deletes a comment of the current user, or any comment
+// on an entry of the current user.
+func deleteComment(w http.ResponseWriter, r *http.Request, commentID string) (Comment, error) {
+	c, err := commentParam(r, commentID)
+	if err != nil {
+		return Comment{}, err
+	}
+	if c.UserID != currentUser(r).ID {
+		if c, err = ownComment(w, r, commentID); err != nil {
+			return Comment{}, err
+		}
+	}
+	return c, reposFor(r).Comments.Delete(c.ID)
+}
+
+// setCommentHidden hides or shows again a comment on an entry of the
+// current user. Hidden comments are only shown to the entry owner.
+func setCommentHidden(w http.ResponseWriter, r *http.Request, commentID string, hidden bool) (Comment, error) {
+	c, err := ownComment(w, r, commentID)
+	if err != nil {
+		return Comment{}, err
+	}
+	if err := reposFor(r).Comments.SetHidden(c.ID, hidden); err != nil {
+		return Comment{}, err
+	}
+	c.Hidden = hidden
+	return c, nil
+}
+
+// setCommentsLocked closes or reopens an entry of the current user for
+// comments by others.
+func setCommentsLocked(w http.ResponseWriter, r *http.Request, entryID string, locked bool) (Entry, error) {
+	entry, err := ownEntry(w, r, entryID)
+	if err != nil {
+		return Entry{}, err
+	}
+	return entry, reposFor(r).Entries.SetCommentsLocked(entry.ID, locked)
+}
+
+func redirectToEntry(w http.ResponseWriter, r *http.Request, entryID int) {
+	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entryID), http.StatusSeeOther)
+}
+
+func PostCommentDelete(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	c, err := deleteComment(w, r, mux.Vars(r)["comment_id"])
+	if err != nil {
+		return err
+	}
+	redirectToEntry(w, r, c.EntryID)
+	return nil
+}
+
+func PostCommentHide(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	c, err := setCommentHidden(w, r, mux.Vars(r)["comment_id"], true)
+	if err != nil {
+		return err
+	}
+	redirectToEntry(w, r, c.EntryID)
+	return nil
+}
+
+func PostCommentUnhide(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	c, err := setCommentHidden(w, r, mux.Vars(r)["comment_id"], false)
+	if err != nil {
+		return err
+	}
+	redirectToEntry(w, r, c.EntryID)
+	return nil
+}
+
+func PostEntryLock(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	entry, err := setCommentsLocked(w, r, mux.Vars(r)["entry_id"], true)
+	if err != nil {
+		return err
+	}
+	redirectToEntry(w, r, entry.ID)
+	return nil
+}
+
+func PostEntryUnlock(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+
+	entry, err := setCommentsLocked(w, r, mux.Vars(r)["entry_id"], false)
+	if err != nil {
+		return err
+	}
+	redirectToEntry(w, r, entry.ID)
+	return nil
+}
+
+func APIDeleteComment(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	if _, err := deleteComment(w, r, mux.Vars(r)["comment_id"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func APIPutCommentHidden(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	var req struct {
+		Hidden bool `json:"hidden"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+	c, err := setCommentHidden(w, r, mux.Vars(r)["comment_id"], req.Hidden)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, c)
+}
+
+func APIPutCommentsLocked(w http.ResponseWriter, r *http.Request) error {
+	if _, err := apiCurrentUser(w, r); err != nil {
+		return err
+	}
+	var req struct {
+		Locked bool `json:"locked"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		return err
+	}
+	entry, err := setCommentsLocked(w, r, mux.Vars(r)["entry_id"], req.Locked)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		EntryID int  `json:"entry_id"`
+		Locked  bool `json:"locked"`
+	}{entry.ID, req.Locked})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Cursor points at one row of a listing ordered by (created_at, id).
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d-%d", c.CreatedAt.UnixNano(), c.ID)))
+}
+
+func parseCursor(s string) (*Cursor, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	var nsec int64
+	var id int
+	if _, err := fmt.Sscanf(string(b), "%d-%d", &nsec, &id); err != nil {
+		return nil, false
+	}
+	return &Cursor{time.Unix(0, nsec), id}, true
+}
+
+// Page holds the cursors to put in ?after= and ?before= for the following
+// and preceding pages. Empty when there is no such page.
+type Page struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// PageRequest selects a page of a listing. Without Cursor it is the first
+// page; otherwise the page right after Cursor, or right before it if Before.
+type PageRequest struct {
+	Cursor *Cursor
+	Before bool
+	Limit  int
+}
+
+// pageRequest reads ?after= or ?before= from the query. A broken cursor
+// just yields the first page.
+func pageRequest(r *http.Request, limit int) PageRequest {
+	p := PageRequest{Limit: limit}
+	if c, ok := parseCursor(r.URL.Query().Get("after")); ok {
+		p.Cursor = c
+	} else if c, ok := parseCursor(r.URL.Query().Get("before")); ok {
+		p.Cursor = c
+		p.Before = true
+	}
+	return p
+}
+
+// scanDesc reports whether rows are fetched in descending order, given the
+// display order of the listing.
+func (p PageRequest) scanDesc(desc bool) bool {
+	return desc != p.Before
+}
+
+// Where returns a condition selecting the rows past the cursor, or "1" for
+// the first page. timeCol and idCol name the ordering columns.
+func (p PageRequest) Where(timeCol, idCol string, desc bool) (string, []interface{}) {
+	if p.Cursor == nil {
+		return "1", nil
+	}
+	op := ">"
+	if p.scanDesc(desc) {
+		op = "<"
+	}
+	return fmt.Sprintf("(%s %s ? OR (%s = ? AND %s %s ?))", timeCol, op, timeCol, idCol, op),
+		[]interface{}{p.Cursor.CreatedAt, p.Cursor.CreatedAt, p.Cursor.ID}
+}
+
+// OrderBy returns the ORDER BY and LIMIT clauses. One row more than Limit is
+// fetched to learn whether another page follows.
+func (p PageRequest) OrderBy(timeCol, idCol string, desc bool) string {
+	dir := "ASC"
+	if p.scanDesc(desc) {
+		dir = "DESC"
+	}
+	return fmt.Sprintf("ORDER BY %s %s, %s %s LIMIT %d", timeCol, dir, idCol, dir, p.Limit+1)
+}
+
+// Finish takes the number of fetched rows and returns how many of them to
+// keep. swap restores display order for backward pages; cursorAt gives the
+// cursor of a kept row in display order.
+func (p PageRequest) Finish(n int, swap func(i, j int), cursorAt func(i int) Cursor) (int, Page) {
+	more := n > p.Limit
+	if more {
+		n = p.Limit
+	}
+	if p.Before {
+		for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+	page := Page{}
+	if n == 0 {
+		return n, page
+	}
+	if (!p.Before && more) || (p.Before && p.Cursor != nil) {
+		page.Next = cursorAt(n - 1).String()
+	}
+	if (p.Before && more) || (!p.Before && p.Cursor != nil) {
+		page.Prev = cursorAt(0).String()
+	}
+	return n, page
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes and verifies users.passhash values.
+// salt is the value of salts.salt for the user; schemes which carry their own
+// salt inside the encoded hash ignore it.
+type PasswordHasher interface {
+	Name() string
+	Hash(passwd, salt string) (string, error)
+	Verify(passwd, salt, passhash string) bool
+	// NeedsRehash reports whether passhash was produced by this scheme with
+	// outdated parameters.
+	NeedsRehash(passhash string) bool
+}
+
+var passwordHasher PasswordHasher = sha512Hasher{}
+
+var passwordHashers = map[string]PasswordHasher{
+	"sha512":   sha512Hasher{},
+	"bcrypt":   bcryptHasher{Cost: bcrypt.DefaultCost},
+	"argon2id": argon2idHasher{Time: 1, Memory: 64 * 1024, Threads: 4, KeyLen: 32},
+}
+
+// hasherFor detects the scheme of an existing passhash.
+func hasherFor(passhash string) PasswordHasher {
+	switch {
+	case strings.HasPrefix(passhash, "$2a$"), strings.HasPrefix(passhash, "$2b$"), strings.HasPrefix(passhash, "$2y$"):
+		return passwordHashers["bcrypt"]
+	case strings.HasPrefix(passhash, "$argon2id$"):
+		return passwordHashers["argon2id"]
+	default:
+		return passwordHashers["sha512"]
+	}
+}
+
+// sha512Hasher is the legacy scheme: hex(SHA-512(passwd + salt)), the same as
+// MySQL's SHA2(CONCAT(passwd, salt), 512).
+type sha512Hasher struct{}
+
+func (sha512Hasher) Name() string { return "sha512" }
+
+func (sha512Hasher) Hash(passwd, salt string) (string, error) {
+	sum := sha512.Sum512([]byte(passwd + salt))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (h sha512Hasher) Verify(passwd, salt, passhash string) bool {
+	hash, _ := h.Hash(passwd, salt)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(passhash))) == 1
+}
+
+func (sha512Hasher) NeedsRehash(passhash string) bool { return false }
+
+type bcryptHasher struct {
+	Cost int
+}
+
+func (bcryptHasher) Name() string { return "bcrypt" }
+
+func (h bcryptHasher) Hash(passwd, salt string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(passwd), h.Cost)
+	return string(b), err
+}
+
+func (bcryptHasher) Verify(passwd, salt, passhash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(passhash), []byte(passwd)) == nil
+}
+
+func (h bcryptHasher) NeedsRehash(passhash string) bool {
+	cost, err := bcrypt.Cost([]byte(passhash))
+	return err != nil || cost != h.Cost
+}
+
+// argon2idHasher encodes hashes in the PHC string format:
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+type argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+}
+
+func (argon2idHasher) Name() string { return "argon2id" }
+
+func (h argon2idHasher) Hash(passwd, salt string) (string, error) {
+	s := make([]byte, 16)
+	if _, err := rand.Read(s); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(passwd), s, h.Time, h.Memory, h.Threads, h.KeyLen)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s", h.Memory, h.Time, h.Threads, enc.EncodeToString(s), enc.EncodeToString(key)), nil
+}
+
+func (h argon2idHasher) Verify(passwd, salt, passhash string) bool {
+	p, ok := parseArgon2id(passhash)
+	if !ok {
+		return false
+	}
+	key := argon2.IDKey([]byte(passwd), p.salt, p.Time, p.Memory, p.Threads, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1
+}
+
+func (h argon2idHasher) NeedsRehash(passhash string) bool {
+	p, ok := parseArgon2id(passhash)
+	return !ok || p.Time != h.Time || p.Memory != h.Memory || p.Threads != h.Threads || uint32(len(p.key)) != h.KeyLen
+}
+
+// Hashes which ask for more than these are rejected rather than verified,
+// so that a bad passhash cannot make every login allocate gigabytes.
+const (
+	maxArgon2idMemory = 1024 * 1024 // KiB
+	maxArgon2idTime   = 16
+)
+
+type argon2idParams struct {
+	argon2idHasher
+	salt []byte
+	key  []byte
+}
+
+func parseArgon2id(passhash string) (argon2idParams, bool) {
+	p := argon2idParams{}
+	parts := strings.Split(passhash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != "v=19" {
+		return p, false
+	}
+	var threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &threads); err != nil {
+		return p, false
+	}
+	// argon2.IDKey panics with no threads and takes only 8 bits of them.
+	if threads == 0 || threads > 255 || p.Time == 0 || p.Time > maxArgon2idTime ||
+		p.Memory < 8*threads || p.Memory > maxArgon2idMemory {
+		return p, false
+	}
+	p.Threads = uint8(threads)
+	var err error
+	enc := base64.RawStdEncoding
+	if p.salt, err = enc.DecodeString(parts[4]); err != nil || len(p.salt) == 0 {
+		return p, false
+	}
+	if p.key, err = enc.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return p, false
+	}
+	return p, true
+}
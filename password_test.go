@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestArgon2idVerifyBadHash(t *testing.T) {
+	h := passwordHashers["argon2id"]
+	good, err := h.Hash("long enough", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Verify("long enough", "", good) {
+		t.Fatalf("Verify(%q) = false", good)
+	}
+	const salt, key = "c2FsdHNhbHRzYWx0", "a2V5a2V5a2V5a2V5"
+	for _, passhash := range []string{
+		"",
+		"$argon2id$",
+		"$argon2id$v=19$m=65536,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=1,p=256$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=1,p=4294967297$" + salt + "$" + key,
+		"$argon2id$v=19$m=16,t=1,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=4294967295,t=1,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=4294967295,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=-1,t=1,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=1,p=4$$" + key,
+		"$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$",
+		"$argon2id$v=19$m=65536,t=1,p=4$!$" + key,
+		"$argon2id$v=16$m=65536,t=1,p=4$" + salt + "$" + key,
+	} {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					t.Errorf("Verify(%q) panicked: %v", passhash, err)
+				}
+			}()
+			if h.Verify("long enough", "", passhash) {
+				t.Errorf("Verify(%q) = true", passhash)
+			}
+		}()
+	}
+}
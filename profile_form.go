@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ProfileForm is the editable part of a profile, as submitted by the user.
+type ProfileForm struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Sex       string `json:"sex"`
+	Birthday  string `json:"birthday"`
+	Pref      string `json:"pref"`
+}
+
+// sexes are the options of the sex field of the profile form.
+var sexes = []string{"未指定", "男性", "女性", "その他"}
+
+// Birthdays must fall within the range the profile form offers.
+var (
+	minBirthday = time.Date(1915, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxBirthday = time.Date(2014, 12, 31, 0, 0, 0, 0, time.UTC)
+)
+
+// validate returns the message for each invalid field, keyed by the name of
+// the field. Sex and pref may be empty, as they are for new users.
+func (f ProfileForm) validate() map[string]string {
+	errs := make(map[string]string)
+	if utf8.RuneCountInString(f.LastName) > 64 {
+		errs["last_name"] = "名字は64文字以内で入力してください"
+	}
+	if utf8.RuneCountInString(f.FirstName) > 64 {
+		errs["first_name"] = "名前は64文字以内で入力してください"
+	}
+	if f.Sex != "" && !containsString(sexes, f.Sex) {
+		errs["sex"] = "性別は選択肢から選んでください"
+	}
+	if _, ok := parseBirthday(f.Birthday); !ok {
+		errs["birthday"] = "誕生日は1915年1月1日から2014年12月31日までの日付を入力してください"
+	}
+	if f.Pref != "" && !containsString(prefs, f.Pref) {
+		errs["pref"] = "住んでいる県は選択肢から選んでください"
+	}
+	return errs
+}
+
+// parseBirthday reads a birthday in the form YYYY-MM-DD. An empty birthday
+// is NULL.
+func parseBirthday(s string) (mysql.NullTime, bool) {
+	if s == "" {
+		return mysql.NullTime{}, true
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil || t.Before(minBirthday) || t.After(maxBirthday) {
+		return mysql.NullTime{}, false
+	}
+	return mysql.NullTime{Time: t, Valid: true}, true
+}
+
+// profileFormOf fills the profile form with the saved profile.
+func profileFormOf(p Profile) ProfileForm {
+	f := ProfileForm{FirstName: p.FirstName, LastName: p.LastName, Sex: p.Sex, Pref: p.Pref}
+	if p.Birthday.Valid {
+		f.Birthday = p.Birthday.Time.Format("2006-01-02")
+	}
+	return f
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
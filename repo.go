@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Every query the site runs while serving a request goes through the
+// repositories below. Handlers get them with reposFor, so the same handlers
+// run on MySQL (MySQLRepos) or on memory (MemoryStore). Only the command
+// line tools (migrate, -rebuild-timeline, -backfill-entries) and the
+// startup checks query MySQL directly.
+//
+// Lookups of a single row return ErrContentNotFound when there is none.
+
+type UserRepo interface {
+	ByID(id int) (*User, error)
+	ByAccountName(name string) (*User, error)
+	ByEmail(email string) (*User, error)
+	// ByIDs returns the users found among ids, in no particular order.
+	ByIDs(ids []int) ([]User, error)
+}
+
+// AccountRepo holds what only the user themselves may change: passwords,
+// account names, email addresses and their verification.
+type AccountRepo interface {
+	// Credentials returns the user with the email address, with passhash and
+	// salt. It is only used to check passwords.
+	Credentials(email string) (*User, string, string, error)
+	// CredentialsByID is Credentials by user ID.
+	CredentialsByID(userID int) (string, string, error)
+	SetPasshash(userID int, passhash string) error
+	// Rehash replaces oldHash only if it is still the passhash of the user.
+	Rehash(userID int, oldHash, newHash string) error
+	// Taken returns ErrAccountNameTaken or ErrEmailTaken if another user has
+	// accountName or email; an empty one is not checked.
+	Taken(accountName, email string) error
+	// Create adds a user with its salt, an empty profile and a pending email
+	// verification.
+	Create(f SignupForm, salt, passhash string) (int, error)
+	SetNickName(userID int, nick string) error
+	// Rename changes the account name and remembers the old one.
+	Rename(user *User, name string) error
+	// RenamedTo returns the current name of the account which was called
+	// oldName.
+	RenamedTo(oldName string) (string, error)
+	// SetEmail changes the email address, which the user has just verified.
+	SetEmail(userID int, email string) error
+	// EmailVerified is false only for signups which have not verified their
+	// address yet.
+	EmailVerified(userID int) (bool, error)
+	// VerifyEmail completes a pending verification of the address.
+	VerifyEmail(userID int, email string) error
+	// PendingVerification returns the user whose address is waiting to be
+	// verified.
+	PendingVerification(email string) (int, error)
+}
+
+// TokenRepo holds the one-time tokens mailed for signup, password reset and
+// email changes. Only their hash is stored.
+type TokenRepo interface {
+	Issue(userID int, purpose, email string, ttl time.Duration) (string, error)
+	// Consume marks the token used and returns its user and email. Used,
+	// expired and unknown tokens are all ErrInvalidToken.
+	Consume(token, purpose string) (int, string, error)
+}
+
+type ProfileRepo interface {
+	// Get returns an empty Profile for users who have never saved one.
+	Get(userID int) (Profile, error)
+	// Update saves a form which has passed validate, creating the profile
+	// of users who have none.
+	Update(userID int, form ProfileForm) error
+}
+
+type EntryRepo interface {
+	// Get returns an entry which has not been deleted.
+	Get(id int) (Entry, error)
+	// ByIDs returns the entries found among ids, deleted ones included.
+	ByIDs(ids []int) ([]Entry, error)
+	// ByUser returns the first limit entries of the user in order of
+	// creation.
+	ByUser(userID int, withPrivate bool, limit int) ([]Entry, error)
+	// List pages through the entries of the user, newest first.
+	List(userID int, withPrivate bool, p PageRequest) ([]Entry, Page, error)
+	Create(userID int, title, content string, private bool) (int, error)
+	// Update keeps the current version of the entry as a revision and
+	// replaces it. It returns ErrPermissionDenied unless userID owns it.
+	Update(id, userID int, title, content string, private bool) error
+	// Delete marks the entry deleted, which hides it and its comments.
+	Delete(id int) error
+	// Revisions returns the previous versions of the entry, newest first.
+	Revisions(id int) ([]EntryRevision, error)
+	CommentsLocked(id int) (bool, error)
+	SetCommentsLocked(id int, locked bool) error
+}
+
+type CommentRepo interface {
+	// Get returns a comment which has not been deleted.
+	Get(id int) (Comment, error)
+	// List pages through the comments on the entry, oldest first.
+	List(entryID int, withHidden bool, p PageRequest) ([]Comment, Page, error)
+	// ForOwner returns the latest comments on the entries of the user,
+	// leaving out hidden ones and those of users either side has blocked.
+	ForOwner(userID, limit int) ([]Comment, error)
+	// Count counts the comments on the entry that are not hidden.
+	Count(entryID int) (int, error)
+	Create(entryID, userID int, comment string) (int, error)
+	Delete(id int) error
+	SetHidden(id int, hidden bool) error
+}
+
+type RelationRepo interface {
+	// List pages through the friends of the user, newest first.
+	List(userID int, p PageRequest) ([]Friend, Page, error)
+	// FriendSet returns every friend of the user with the time the
+	// friendship started, for the friend cache.
+	FriendSet(userID int) (map[int]time.Time, error)
+	// Delete ends the friendship of the two users.
+	Delete(userID, anotherID int) error
+}
+
+type FriendRequestRepo interface {
+	// Pending returns "incoming" or "outgoing", seen from userID, if a
+	// request between the two users is pending, and "" otherwise.
+	Pending(userID, anotherID int) (string, error)
+	Create(requesterID, addresseeID int) error
+	// Accept turns the request into a friendship, or returns
+	// ErrContentNotFound if there is no such request.
+	Accept(requesterID, addresseeID int) error
+	// Delete removes the request, or returns ErrContentNotFound if there is
+	// none.
+	Delete(requesterID, addresseeID int) error
+	// Count counts the requests addressed to the user.
+	Count(userID int) (int, error)
+	// List returns the requests addressed to userID (incoming) or sent by
+	// userID (outgoing), newest first.
+	List(userID int, incoming bool) ([]FriendRequest, error)
+}
+
+type BlockRepo interface {
+	// Between reports whether either user has blocked the other.
+	Between(userID, anotherID int) (bool, error)
+	// Create blocks another for userID, ending their friendship and any
+	// pending friend request between them.
+	Create(userID, anotherID int) error
+	Delete(userID, anotherID int) error
+	// List returns the users blocked by userID, newest first.
+	List(userID int) ([]Block, error)
+}
+
+// TimelineRepo holds the feeds of friends' entries and comments on the
+// index page. Items are added when they are written and checked again for
+// friendship, privacy and blocks when they are read.
+type TimelineRepo interface {
+	AddEntry(entryID int) error
+	AddComment(commentID int) error
+	// Backfill copies the latest items of friendID into the timeline of
+	// userID.
+	Backfill(userID, friendID int) error
+	// DropBetween removes what the two users wrote from each other's
+	// timelines.
+	DropBetween(userID, anotherID int) error
+	Entries(userID, limit int) ([]Entry, error)
+	Comments(userID, limit int) ([]Comment, error)
+}
+
+type LoginRepo interface {
+	// Record stores a login; userID is 0 for unknown addresses.
+	Record(userID int, email, ip string, succeeded bool) error
+	// Recent returns the last limit logins with the email address, newest
+	// first, whether or not an account has it.
+	Recent(email string, limit int) ([]LoginAttempt, error)
+	// Failed returns the failed logins to the account in the last 30 days,
+	// newest first.
+	Failed(userID, limit int) ([]LoginAttempt, error)
+	// ResetLockout marks the failures with the email address until now as
+	// no longer counting towards a lockout.
+	ResetLockout(email string) error
+	// LockoutReset returns when ResetLockout was last called for the email
+	// address, or the zero time.
+	LockoutReset(email string) (time.Time, error)
+}
+
+type AdminRepo interface {
+	// Initialize puts the initial data back as it was, undoing every change
+	// made through the site.
+	Initialize() error
+}
+
+type FootprintRepo interface {
+	Add(userID, ownerID int) error
+	// List pages through the visitors of the user, one per visitor and day,
+	// latest visit first.
+	List(userID int, p PageRequest) ([]Footprint, Page, error)
+}
+
+type Repos struct {
+	Users          UserRepo
+	Accounts       AccountRepo
+	Tokens         TokenRepo
+	Profiles       ProfileRepo
+	Entries        EntryRepo
+	Comments       CommentRepo
+	Relations      RelationRepo
+	FriendRequests FriendRequestRepo
+	Blocks         BlockRepo
+	Footprints     FootprintRepo
+	Timeline       TimelineRepo
+	Logins         LoginRepo
+	Admin          AdminRepo
+}
+
+// RepoSource gives the repositories to serve a request with.
+type RepoSource func(r *http.Request) Repos
+
+// reposFor returns the repositories of the request, which withRepos has
+// chosen.
+func reposFor(r *http.Request) Repos {
+	st := stateOf(r)
+	if st.repos == nil {
+		if st.repoSource == nil {
+			panic("no repositories for " + r.URL.Path)
+		}
+		repos := st.repoSource(r)
+		st.repos = &repos
+	}
+	return *st.repos
+}
+
+// withRepos serves h with the repositories of source.
+func withRepos(source RepoSource, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, st := withState(r)
+		st.repoSource = source
+		h.ServeHTTP(w, r)
+	})
+}
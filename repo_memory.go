@@ -0,0 +1,1102 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the tables behind the repositories in memory, for tests
+// which should not need MySQL. Its Repos method is a RepoSource.
+type MemoryStore struct {
+	mu sync.Mutex
+	memoryTables
+	// initial is what Initialize puts back; see MarkInitial.
+	initial memoryTables
+	lastID  int
+}
+
+type memoryTables struct {
+	users         map[int]User
+	accounts      map[int]memoryAccount
+	verifications map[int]memoryVerification
+	renamed       map[string]int // old account name to user ID
+	tokens        map[string]memoryToken
+	profiles      map[int]Profile
+	entries       []Entry
+	revisions     []EntryRevision
+	comments      []Comment
+	// deleted has the IDs of deleted entries and comments, and locked those
+	// of entries locked against comments.
+	deleted        map[int]bool
+	locked         map[int]bool
+	relations      []memoryRelation
+	friendRequests []memoryFriendRequest
+	blocks         []memoryBlock
+	footprints     []Footprint
+	logins         []memoryLogin
+	lockoutResets  map[string]time.Time
+}
+
+type memoryAccount struct {
+	passhash string
+	salt     string
+}
+
+type memoryVerification struct {
+	email    string
+	verified bool
+}
+
+type memoryToken struct {
+	userID  int
+	purpose string
+	email   string
+	expires time.Time
+	used    bool
+}
+
+type memoryFriendRequest struct {
+	requesterID int
+	addresseeID int
+	createdAt   time.Time
+}
+
+type memoryBlock struct {
+	blockerID int
+	Block
+}
+
+type memoryLogin struct {
+	userID int
+	email  string
+	LoginAttempt
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{memoryTables: memoryTables{
+		users:         make(map[int]User),
+		accounts:      make(map[int]memoryAccount),
+		verifications: make(map[int]memoryVerification),
+		renamed:       make(map[string]int),
+		tokens:        make(map[string]memoryToken),
+		profiles:      make(map[int]Profile),
+		deleted:       make(map[int]bool),
+		locked:        make(map[int]bool),
+		lockoutResets: make(map[string]time.Time),
+	}}
+	s.initial = s.memoryTables.clone()
+	return s
+}
+
+// MarkInitial takes what the store holds now as its initial data, which
+// Initialize puts back.
+func (s *MemoryStore) MarkInitial() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initial = s.memoryTables.clone()
+}
+
+// clone copies the tables, so that changing one copy leaves the other as
+// it was.
+func (t memoryTables) clone() memoryTables {
+	c := t
+	c.users = make(map[int]User, len(t.users))
+	for k, v := range t.users {
+		c.users[k] = v
+	}
+	c.accounts = make(map[int]memoryAccount, len(t.accounts))
+	for k, v := range t.accounts {
+		c.accounts[k] = v
+	}
+	c.verifications = make(map[int]memoryVerification, len(t.verifications))
+	for k, v := range t.verifications {
+		c.verifications[k] = v
+	}
+	c.renamed = make(map[string]int, len(t.renamed))
+	for k, v := range t.renamed {
+		c.renamed[k] = v
+	}
+	c.tokens = make(map[string]memoryToken, len(t.tokens))
+	for k, v := range t.tokens {
+		c.tokens[k] = v
+	}
+	c.profiles = make(map[int]Profile, len(t.profiles))
+	for k, v := range t.profiles {
+		c.profiles[k] = v
+	}
+	c.deleted = make(map[int]bool, len(t.deleted))
+	for k, v := range t.deleted {
+		c.deleted[k] = v
+	}
+	c.locked = make(map[int]bool, len(t.locked))
+	for k, v := range t.locked {
+		c.locked[k] = v
+	}
+	c.lockoutResets = make(map[string]time.Time, len(t.lockoutResets))
+	for k, v := range t.lockoutResets {
+		c.lockoutResets[k] = v
+	}
+	c.entries = append([]Entry(nil), t.entries...)
+	c.revisions = append([]EntryRevision(nil), t.revisions...)
+	c.comments = append([]Comment(nil), t.comments...)
+	c.relations = append([]memoryRelation(nil), t.relations...)
+	c.friendRequests = append([]memoryFriendRequest(nil), t.friendRequests...)
+	c.blocks = append([]memoryBlock(nil), t.blocks...)
+	c.footprints = append([]Footprint(nil), t.footprints...)
+	c.logins = append([]memoryLogin(nil), t.logins...)
+	return c
+}
+
+func (s *MemoryStore) Repos(r *http.Request) Repos {
+	return Repos{
+		Users:          memoryUsers{s},
+		Accounts:       memoryAccounts{s},
+		Tokens:         memoryTokens{s},
+		Profiles:       memoryProfiles{s},
+		Entries:        memoryEntries{s},
+		Comments:       memoryComments{s},
+		Relations:      memoryRelations{s},
+		FriendRequests: memoryFriendRequests{s},
+		Blocks:         memoryBlocks{s},
+		Footprints:     memoryFootprints{s},
+		Timeline:       memoryTimeline{s},
+		Logins:         memoryLogins{s},
+		Admin:          memoryAdmin{s},
+	}
+}
+
+// nextID numbers the rows of every table from one sequence, which keeps IDs
+// unique enough for tests.
+func (s *MemoryStore) nextID() int {
+	s.lastID++
+	return s.lastID
+}
+
+// AddUser stores the user with an empty profile under a new ID and returns
+// it. Like the users of the seed data, it has a verified email address, but
+// it cannot log in before SetPassword.
+func (s *MemoryStore) AddUser(accountName, nickName, email string) User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := User{s.nextID(), accountName, nickName, email}
+	s.users[u.ID] = u
+	s.profiles[u.ID] = Profile{UserID: u.ID}
+	return u
+}
+
+// SetPassword gives the user a new salt and passwd hashed with the
+// configured scheme.
+func (s *MemoryStore) SetPassword(userID int, passwd string) error {
+	salt, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	salt = salt[:20]
+	passhash, err := passwordHasher.Hash(passwd, salt)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts[userID] = memoryAccount{passhash, salt}
+	return nil
+}
+
+// AddFriends makes the two users friends, in both directions like relations.
+func (s *MemoryStore) AddFriends(one, another int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addFriends(one, another)
+}
+
+func (s *MemoryStore) addFriends(one, another int) {
+	if s.friends(one)[another] {
+		return
+	}
+	now := time.Now()
+	s.relations = append(s.relations, memoryRelation{one, Friend{another, now}}, memoryRelation{another, Friend{one, now}})
+}
+
+// friends returns the set of friends of the user.
+func (s *MemoryStore) friends(userID int) map[int]bool {
+	friends := make(map[int]bool)
+	for _, rel := range s.relations {
+		if rel.one == userID {
+			friends[rel.ID] = true
+		}
+	}
+	return friends
+}
+
+func (s *MemoryStore) removeFriends(one, another int) {
+	relations := s.relations[:0]
+	for _, rel := range s.relations {
+		if rel.one == one && rel.ID == another || rel.one == another && rel.ID == one {
+			continue
+		}
+		relations = append(relations, rel)
+	}
+	s.relations = relations
+}
+
+func (s *MemoryStore) blocked(one, another int) bool {
+	for _, b := range s.blocks {
+		if b.blockerID == one && b.UserID == another || b.blockerID == another && b.UserID == one {
+			return true
+		}
+	}
+	return false
+}
+
+// entry returns the entry with the ID, deleted or not.
+func (s *MemoryStore) entry(id int) (Entry, bool) {
+	for _, e := range s.entries {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// memoryRelation is a row of relations: Friend is a friend of one.
+type memoryRelation struct {
+	one int
+	Friend
+}
+
+// memoryPage applies p to n rows the way PageRequest.Where and OrderBy do in
+// SQL, and returns the indexes of the rows to fetch in scan order.
+func memoryPage(p PageRequest, n int, cursorAt func(i int) Cursor, desc bool) []int {
+	scanDesc := p.scanDesc(desc)
+	idx := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		if p.Cursor != nil {
+			c := cursorAt(i)
+			if scanDesc && !cursorLess(c, *p.Cursor) || !scanDesc && !cursorLess(*p.Cursor, c) {
+				continue
+			}
+		}
+		idx = append(idx, i)
+	}
+	sort.Sort(cursorOrder{idx, cursorAt, scanDesc})
+	if len(idx) > p.Limit+1 {
+		idx = idx[:p.Limit+1]
+	}
+	return idx
+}
+
+func cursorLess(a, b Cursor) bool {
+	return a.CreatedAt.Before(b.CreatedAt) || a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID
+}
+
+type cursorOrder struct {
+	idx      []int
+	cursorAt func(i int) Cursor
+	desc     bool
+}
+
+func (o cursorOrder) Len() int      { return len(o.idx) }
+func (o cursorOrder) Swap(i, j int) { o.idx[i], o.idx[j] = o.idx[j], o.idx[i] }
+func (o cursorOrder) Less(i, j int) bool {
+	a, b := o.cursorAt(o.idx[i]), o.cursorAt(o.idx[j])
+	if o.desc {
+		return cursorLess(b, a)
+	}
+	return cursorLess(a, b)
+}
+
+type memoryUsers struct{ s *MemoryStore }
+
+func (m memoryUsers) ByID(id int) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	u, ok := m.s.users[id]
+	if !ok {
+		return nil, ErrContentNotFound
+	}
+	return &u, nil
+}
+
+func (m memoryUsers) ByAccountName(name string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, u := range m.s.users {
+		if u.AccountName == name {
+			return &u, nil
+		}
+	}
+	return nil, ErrContentNotFound
+}
+
+func (m memoryUsers) ByEmail(email string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, u := range m.s.users {
+		if u.Email == email {
+			return &u, nil
+		}
+	}
+	return nil, ErrContentNotFound
+}
+
+func (m memoryUsers) ByIDs(ids []int) ([]User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	users := make([]User, 0, len(ids))
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if u, ok := m.s.users[id]; ok && !seen[id] {
+			seen[id] = true
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+type memoryAccounts struct{ s *MemoryStore }
+
+func (m memoryAccounts) Credentials(email string) (*User, string, string, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, u := range m.s.users {
+		if a, ok := m.s.accounts[u.ID]; ok && u.Email == email {
+			return &u, a.passhash, a.salt, nil
+		}
+	}
+	return nil, "", "", ErrContentNotFound
+}
+
+func (m memoryAccounts) CredentialsByID(userID int) (string, string, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	a, ok := m.s.accounts[userID]
+	if !ok {
+		return "", "", ErrContentNotFound
+	}
+	return a.passhash, a.salt, nil
+}
+
+func (m memoryAccounts) SetPasshash(userID int, passhash string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if a, ok := m.s.accounts[userID]; ok {
+		a.passhash = passhash
+		m.s.accounts[userID] = a
+	}
+	return nil
+}
+
+func (m memoryAccounts) Rehash(userID int, oldHash, newHash string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if a, ok := m.s.accounts[userID]; ok && a.passhash == oldHash {
+		a.passhash = newHash
+		m.s.accounts[userID] = a
+	}
+	return nil
+}
+
+func (m memoryAccounts) Taken(accountName, email string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	return m.taken(0, accountName, email)
+}
+
+// taken is Taken for users other than userID.
+func (m memoryAccounts) taken(userID int, accountName, email string) error {
+	for _, u := range m.s.users {
+		switch {
+		case u.ID == userID:
+		case accountName != "" && u.AccountName == accountName:
+			return ErrAccountNameTaken
+		case email != "" && u.Email == email:
+			return ErrEmailTaken
+		}
+	}
+	return nil
+}
+
+func (m memoryAccounts) Create(f SignupForm, salt, passhash string) (int, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if err := m.taken(0, f.AccountName, f.Email); err != nil {
+		return 0, err
+	}
+	u := User{m.s.nextID(), f.AccountName, f.NickName, f.Email}
+	m.s.users[u.ID] = u
+	m.s.accounts[u.ID] = memoryAccount{passhash, salt}
+	m.s.profiles[u.ID] = Profile{UserID: u.ID}
+	m.s.verifications[u.ID] = memoryVerification{email: f.Email}
+	return u.ID, nil
+}
+
+func (m memoryAccounts) SetNickName(userID int, nick string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if u, ok := m.s.users[userID]; ok {
+		u.NickName = nick
+		m.s.users[userID] = u
+	}
+	return nil
+}
+
+func (m memoryAccounts) Rename(user *User, name string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if err := m.taken(user.ID, name, ""); err != nil {
+		return err
+	}
+	u, ok := m.s.users[user.ID]
+	if !ok {
+		return ErrContentNotFound
+	}
+	u.AccountName = name
+	m.s.users[user.ID] = u
+	delete(m.s.renamed, name)
+	m.s.renamed[user.AccountName] = user.ID
+	return nil
+}
+
+func (m memoryAccounts) RenamedTo(oldName string) (string, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	u, ok := m.s.users[m.s.renamed[oldName]]
+	if !ok {
+		return "", ErrContentNotFound
+	}
+	return u.AccountName, nil
+}
+
+func (m memoryAccounts) SetEmail(userID int, email string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if err := m.taken(userID, "", email); err != nil {
+		return err
+	}
+	u, ok := m.s.users[userID]
+	if !ok {
+		return ErrContentNotFound
+	}
+	u.Email = email
+	m.s.users[userID] = u
+	if _, ok := m.s.verifications[userID]; ok {
+		m.s.verifications[userID] = memoryVerification{email, true}
+	}
+	return nil
+}
+
+func (m memoryAccounts) EmailVerified(userID int) (bool, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	v, ok := m.s.verifications[userID]
+	return !ok || v.verified, nil
+}
+
+func (m memoryAccounts) VerifyEmail(userID int, email string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if v, ok := m.s.verifications[userID]; ok && v.email == email {
+		m.s.verifications[userID] = memoryVerification{email, true}
+	}
+	return nil
+}
+
+func (m memoryAccounts) PendingVerification(email string) (int, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for userID, v := range m.s.verifications {
+		if v.email == email && !v.verified {
+			return userID, nil
+		}
+	}
+	return 0, ErrContentNotFound
+}
+
+type memoryTokens struct{ s *MemoryStore }
+
+func (m memoryTokens) Issue(userID int, purpose, email string, ttl time.Duration) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.tokens[sessionKey(token)] = memoryToken{userID, purpose, email, time.Now().Add(ttl), false}
+	return token, nil
+}
+
+func (m memoryTokens) Consume(token, purpose string) (int, string, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	key := sessionKey(token)
+	t, ok := m.s.tokens[key]
+	if !ok || t.used || t.purpose != purpose || !time.Now().Before(t.expires) {
+		return 0, "", ErrInvalidToken
+	}
+	t.used = true
+	m.s.tokens[key] = t
+	return t.userID, t.email, nil
+}
+
+type memoryProfiles struct{ s *MemoryStore }
+
+func (m memoryProfiles) Get(userID int) (Profile, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	return m.s.profiles[userID], nil
+}
+
+func (m memoryProfiles) Update(userID int, form ProfileForm) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	prof := Profile{UserID: userID}
+	prof.FirstName, prof.LastName, prof.Sex, prof.Pref = form.FirstName, form.LastName, form.Sex, form.Pref
+	prof.Birthday, _ = parseBirthday(form.Birthday)
+	prof.UpdatedAt = time.Now()
+	m.s.profiles[userID] = prof
+	return nil
+}
+
+type memoryEntries struct{ s *MemoryStore }
+
+func (m memoryEntries) Get(id int) (Entry, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	e, ok := m.s.entry(id)
+	if !ok || m.s.deleted[id] {
+		return Entry{}, ErrContentNotFound
+	}
+	return e, nil
+}
+
+func (m memoryEntries) ByIDs(ids []int) ([]Entry, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	want := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	entries := make([]Entry, 0, len(ids))
+	for _, e := range m.s.entries {
+		if want[e.ID] {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// visible returns the entries of the user in order of creation.
+func (m memoryEntries) visible(userID int, withPrivate bool) []Entry {
+	entries := make([]Entry, 0)
+	for _, e := range m.s.entries {
+		if e.UserID == userID && (withPrivate || !e.Private) && !m.s.deleted[e.ID] {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (m memoryEntries) ByUser(userID int, withPrivate bool, limit int) ([]Entry, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	entries := m.visible(userID, withPrivate)
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (m memoryEntries) List(userID int, withPrivate bool, p PageRequest) ([]Entry, Page, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	all := m.visible(userID, withPrivate)
+	idx := memoryPage(p, len(all), func(i int) Cursor { return Cursor{all[i].CreatedAt, all[i].ID} }, true)
+	entries := make([]Entry, len(idx))
+	for i, j := range idx {
+		entries[i] = all[j]
+	}
+	n, page := p.Finish(len(entries),
+		func(i, j int) { entries[i], entries[j] = entries[j], entries[i] },
+		func(i int) Cursor { return Cursor{entries[i].CreatedAt, entries[i].ID} })
+	return entries[:n], page, nil
+}
+
+func (m memoryEntries) Create(userID int, title, content string, private bool) (int, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	e := Entry{m.s.nextID(), userID, private, title, content, time.Now()}
+	m.s.entries = append(m.s.entries, e)
+	return e.ID, nil
+}
+
+func (m memoryEntries) Update(id, userID int, title, content string, private bool) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for i, old := range m.s.entries {
+		if old.ID != id || m.s.deleted[id] {
+			continue
+		}
+		if old.UserID != userID {
+			return ErrPermissionDenied
+		}
+		m.s.revisions = append(m.s.revisions, EntryRevision{m.s.nextID(), id, old.Private, old.Title, old.Content, time.Now()})
+		m.s.entries[i].Title, m.s.entries[i].Content, m.s.entries[i].Private = title, content, private
+		return nil
+	}
+	return ErrContentNotFound
+}
+
+func (m memoryEntries) Delete(id int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.deleted[id] = true
+	return nil
+}
+
+func (m memoryEntries) Revisions(id int) ([]EntryRevision, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	revisions := make([]EntryRevision, 0)
+	for i := len(m.s.revisions) - 1; i >= 0; i-- {
+		if m.s.revisions[i].EntryID == id {
+			revisions = append(revisions, m.s.revisions[i])
+		}
+	}
+	return revisions, nil
+}
+
+func (m memoryEntries) CommentsLocked(id int) (bool, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.entry(id); !ok {
+		return false, ErrContentNotFound
+	}
+	return m.s.locked[id], nil
+}
+
+func (m memoryEntries) SetCommentsLocked(id int, locked bool) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.locked[id] = locked
+	return nil
+}
+
+type memoryComments struct{ s *MemoryStore }
+
+func (m memoryComments) Get(id int) (Comment, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, c := range m.s.comments {
+		if c.ID == id && !m.s.deleted[id] {
+			return c, nil
+		}
+	}
+	return Comment{}, ErrContentNotFound
+}
+
+func (m memoryComments) List(entryID int, withHidden bool, p PageRequest) ([]Comment, Page, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	all := make([]Comment, 0)
+	for _, c := range m.s.comments {
+		if c.EntryID == entryID && (withHidden || !c.Hidden) && !m.s.deleted[c.ID] {
+			all = append(all, c)
+		}
+	}
+	idx := memoryPage(p, len(all), func(i int) Cursor { return Cursor{all[i].CreatedAt, all[i].ID} }, false)
+	comments := make([]Comment, len(idx))
+	for i, j := range idx {
+		comments[i] = all[j]
+	}
+	n, page := p.Finish(len(comments),
+		func(i, j int) { comments[i], comments[j] = comments[j], comments[i] },
+		func(i int) Cursor { return Cursor{comments[i].CreatedAt, comments[i].ID} })
+	return comments[:n], page, nil
+}
+
+func (m memoryComments) Count(entryID int) (int, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	n := 0
+	for _, c := range m.s.comments {
+		if c.EntryID == entryID && !c.Hidden && !m.s.deleted[c.ID] {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m memoryComments) Create(entryID, userID int, comment string) (int, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	c := Comment{m.s.nextID(), entryID, userID, comment, time.Now(), false}
+	m.s.comments = append(m.s.comments, c)
+	return c.ID, nil
+}
+
+func (m memoryComments) ForOwner(userID, limit int) ([]Comment, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	comments := make([]Comment, 0, limit)
+	for i := len(m.s.comments) - 1; i >= 0 && len(comments) < limit; i-- {
+		c := m.s.comments[i]
+		e, ok := m.s.entry(c.EntryID)
+		if !ok || e.UserID != userID || m.s.deleted[e.ID] || m.s.deleted[c.ID] || c.Hidden || m.s.blocked(userID, c.UserID) {
+			continue
+		}
+		comments = append(comments, c)
+	}
+	return comments, nil
+}
+
+func (m memoryComments) Delete(id int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.deleted[id] = true
+	return nil
+}
+
+func (m memoryComments) SetHidden(id int, hidden bool) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for i := range m.s.comments {
+		if m.s.comments[i].ID == id {
+			m.s.comments[i].Hidden = hidden
+		}
+	}
+	return nil
+}
+
+type memoryRelations struct{ s *MemoryStore }
+
+func (m memoryRelations) List(userID int, p PageRequest) ([]Friend, Page, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	all := make([]Friend, 0)
+	for _, rel := range m.s.relations {
+		if rel.one == userID {
+			all = append(all, rel.Friend)
+		}
+	}
+	idx := memoryPage(p, len(all), func(i int) Cursor { return Cursor{all[i].CreatedAt, all[i].ID} }, true)
+	friends := make([]Friend, len(idx))
+	for i, j := range idx {
+		friends[i] = all[j]
+	}
+	n, page := p.Finish(len(friends),
+		func(i, j int) { friends[i], friends[j] = friends[j], friends[i] },
+		func(i int) Cursor { return Cursor{friends[i].CreatedAt, friends[i].ID} })
+	return friends[:n], page, nil
+}
+
+func (m memoryRelations) FriendSet(userID int) (map[int]time.Time, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	friends := make(map[int]time.Time)
+	for _, rel := range m.s.relations {
+		if rel.one == userID {
+			friends[rel.ID] = rel.CreatedAt
+		}
+	}
+	return friends, nil
+}
+
+func (m memoryRelations) Delete(userID, anotherID int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.removeFriends(userID, anotherID)
+	return nil
+}
+
+type memoryFriendRequests struct{ s *MemoryStore }
+
+func (m memoryFriendRequests) Pending(userID, anotherID int) (string, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, fr := range m.s.friendRequests {
+		switch {
+		case fr.requesterID == userID && fr.addresseeID == anotherID:
+			return "outgoing", nil
+		case fr.requesterID == anotherID && fr.addresseeID == userID:
+			return "incoming", nil
+		}
+	}
+	return "", nil
+}
+
+func (m memoryFriendRequests) Create(requesterID, addresseeID int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, fr := range m.s.friendRequests {
+		if fr.requesterID == requesterID && fr.addresseeID == addresseeID {
+			return nil
+		}
+	}
+	m.s.friendRequests = append(m.s.friendRequests, memoryFriendRequest{requesterID, addresseeID, time.Now()})
+	return nil
+}
+
+func (m memoryFriendRequests) Accept(requesterID, addresseeID int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if !m.remove(requesterID, addresseeID) {
+		return ErrContentNotFound
+	}
+	m.s.addFriends(addresseeID, requesterID)
+	return nil
+}
+
+func (m memoryFriendRequests) Delete(requesterID, addresseeID int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if !m.remove(requesterID, addresseeID) {
+		return ErrContentNotFound
+	}
+	return nil
+}
+
+// remove reports whether there was a request to remove.
+func (m memoryFriendRequests) remove(requesterID, addresseeID int) bool {
+	for i, fr := range m.s.friendRequests {
+		if fr.requesterID == requesterID && fr.addresseeID == addresseeID {
+			m.s.friendRequests = append(m.s.friendRequests[:i], m.s.friendRequests[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (m memoryFriendRequests) Count(userID int) (int, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	n := 0
+	for _, fr := range m.s.friendRequests {
+		if fr.addresseeID == userID {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m memoryFriendRequests) List(userID int, incoming bool) ([]FriendRequest, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	requests := make([]FriendRequest, 0)
+	for i := len(m.s.friendRequests) - 1; i >= 0; i-- {
+		fr := m.s.friendRequests[i]
+		switch {
+		case incoming && fr.addresseeID == userID:
+			requests = append(requests, FriendRequest{fr.requesterID, fr.createdAt})
+		case !incoming && fr.requesterID == userID:
+			requests = append(requests, FriendRequest{fr.addresseeID, fr.createdAt})
+		}
+	}
+	return requests, nil
+}
+
+type memoryBlocks struct{ s *MemoryStore }
+
+func (m memoryBlocks) Between(userID, anotherID int) (bool, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	return m.s.blocked(userID, anotherID), nil
+}
+
+func (m memoryBlocks) Create(userID, anotherID int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	exists := false
+	for _, b := range m.s.blocks {
+		exists = exists || b.blockerID == userID && b.UserID == anotherID
+	}
+	if !exists {
+		m.s.blocks = append(m.s.blocks, memoryBlock{userID, Block{anotherID, time.Now()}})
+	}
+	m.s.removeFriends(userID, anotherID)
+	requests := m.s.friendRequests[:0]
+	for _, fr := range m.s.friendRequests {
+		if fr.requesterID == userID && fr.addresseeID == anotherID || fr.requesterID == anotherID && fr.addresseeID == userID {
+			continue
+		}
+		requests = append(requests, fr)
+	}
+	m.s.friendRequests = requests
+	return nil
+}
+
+func (m memoryBlocks) Delete(userID, anotherID int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	blocks := m.s.blocks[:0]
+	for _, b := range m.s.blocks {
+		if b.blockerID != userID || b.UserID != anotherID {
+			blocks = append(blocks, b)
+		}
+	}
+	m.s.blocks = blocks
+	return nil
+}
+
+func (m memoryBlocks) List(userID int) ([]Block, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	blocks := make([]Block, 0)
+	for i := len(m.s.blocks) - 1; i >= 0; i-- {
+		if m.s.blocks[i].blockerID == userID {
+			blocks = append(blocks, m.s.blocks[i].Block)
+		}
+	}
+	return blocks, nil
+}
+
+type memoryFootprints struct{ s *MemoryStore }
+
+func (m memoryFootprints) Add(userID, ownerID int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	now := time.Now()
+	m.s.footprints = append(m.s.footprints, Footprint{userID, ownerID, now, now})
+	return nil
+}
+
+// List groups the visits like the GROUP BY of mysqlFootprints.
+func (m memoryFootprints) List(userID int, p PageRequest) ([]Footprint, Page, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	type key struct {
+		ownerID int
+		date    time.Time
+	}
+	groups := make(map[key]int)
+	all := make([]Footprint, 0)
+	for _, fp := range m.s.footprints {
+		if fp.UserID != userID {
+			continue
+		}
+		y, mo, d := fp.CreatedAt.Date()
+		k := key{fp.OwnerID, time.Date(y, mo, d, 0, 0, 0, 0, fp.CreatedAt.Location())}
+		if i, ok := groups[k]; ok {
+			if fp.CreatedAt.After(all[i].Updated) {
+				all[i].Updated = fp.CreatedAt
+			}
+			continue
+		}
+		groups[k] = len(all)
+		all = append(all, Footprint{userID, fp.OwnerID, k.date, fp.CreatedAt})
+	}
+	idx := memoryPage(p, len(all), func(i int) Cursor { return Cursor{all[i].Updated, all[i].OwnerID} }, true)
+	footprints := make([]Footprint, len(idx))
+	for i, j := range idx {
+		footprints[i] = all[j]
+	}
+	n, page := p.Finish(len(footprints),
+		func(i, j int) { footprints[i], footprints[j] = footprints[j], footprints[i] },
+		func(i int) Cursor { return Cursor{footprints[i].Updated, footprints[i].OwnerID} })
+	return footprints[:n], page, nil
+}
+
+// memoryTimeline keeps no feeds: it finds the items of friends when they
+// are read, with the checks loadTimelineEntries and loadTimelineComments
+// make in SQL.
+type memoryTimeline struct{ s *MemoryStore }
+
+func (m memoryTimeline) AddEntry(entryID int) error              { return nil }
+func (m memoryTimeline) AddComment(commentID int) error          { return nil }
+func (m memoryTimeline) Backfill(userID, friendID int) error     { return nil }
+func (m memoryTimeline) DropBetween(userID, anotherID int) error { return nil }
+
+func (m memoryTimeline) Entries(userID, limit int) ([]Entry, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	friends := m.s.friends(userID)
+	entries := make([]Entry, 0, limit)
+	for i := len(m.s.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		e := m.s.entries[i]
+		if friends[e.UserID] && !m.s.deleted[e.ID] {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (m memoryTimeline) Comments(userID, limit int) ([]Comment, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	friends := m.s.friends(userID)
+	comments := make([]Comment, 0, limit)
+	for i := len(m.s.comments) - 1; i >= 0 && len(comments) < limit; i-- {
+		c := m.s.comments[i]
+		if !friends[c.UserID] || c.Hidden || m.s.deleted[c.ID] {
+			continue
+		}
+		e, ok := m.s.entry(c.EntryID)
+		if !ok || m.s.deleted[e.ID] || m.s.blocked(userID, e.UserID) {
+			continue
+		}
+		if e.Private && e.UserID != userID && !friends[e.UserID] {
+			continue
+		}
+		comments = append(comments, c)
+	}
+	return comments, nil
+}
+
+type memoryLogins struct{ s *MemoryStore }
+
+func (m memoryLogins) Record(userID int, email, ip string, succeeded bool) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.logins = append(m.s.logins, memoryLogin{userID, email, LoginAttempt{ip, time.Now(), succeeded}})
+	return nil
+}
+
+func (m memoryLogins) Recent(email string, limit int) ([]LoginAttempt, error) {
+	return m.find(limit, func(l memoryLogin) bool { return strings.EqualFold(l.email, email) }), nil
+}
+
+func (m memoryLogins) Failed(userID, limit int) ([]LoginAttempt, error) {
+	since := time.Now().AddDate(0, 0, -30)
+	return m.find(limit, func(l memoryLogin) bool {
+		return l.userID == userID && !l.Succeeded && l.CreatedAt.After(since)
+	}), nil
+}
+
+func (m memoryLogins) ResetLockout(email string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.lockoutResets[strings.ToLower(email)] = time.Now()
+	return nil
+}
+
+func (m memoryLogins) LockoutReset(email string) (time.Time, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	return m.s.lockoutResets[strings.ToLower(email)], nil
+}
+
+// find returns the latest limit logins that match.
+func (m memoryLogins) find(limit int, match func(memoryLogin) bool) []LoginAttempt {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	attempts := make([]LoginAttempt, 0, limit)
+	for i := len(m.s.logins) - 1; i >= 0 && len(attempts) < limit; i-- {
+		if match(m.s.logins[i]) {
+			attempts = append(attempts, m.s.logins[i].LoginAttempt)
+		}
+	}
+	return attempts
+}
+
+type memoryAdmin struct{ s *MemoryStore }
+
+// Initialize puts back the tables as MarkInitial saw them. IDs keep counting
+// from where they were, like AUTO_INCREMENT.
+func (m memoryAdmin) Initialize() error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.memoryTables = m.s.initial.clone()
+	return nil
+}
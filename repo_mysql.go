@@ -0,0 +1,949 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQLRepos returns the RepoSource of the site on conn. The repositories
+// of each request run their queries on a copy of conn which logs them under
+// the ID of the request.
+func MySQLRepos(conn *DB) RepoSource {
+	return func(r *http.Request) Repos {
+		st := stateOf(r)
+		q := &DB{conn.DB, st.id, &st.queries}
+		return Repos{
+			Users:          mysqlUsers{q},
+			Accounts:       mysqlAccounts{q},
+			Tokens:         mysqlTokens{q},
+			Profiles:       mysqlProfiles{q},
+			Entries:        mysqlEntries{q},
+			Comments:       mysqlComments{q},
+			Relations:      mysqlRelations{q},
+			FriendRequests: mysqlFriendRequests{q},
+			Blocks:         mysqlBlocks{q},
+			Footprints:     mysqlFootprints{q},
+			Timeline:       mysqlTimeline{q},
+			Logins:         mysqlLogins{q},
+			Admin:          mysqlAdmin{q},
+		}
+	}
+}
+
+// inClause returns "?,?,..." and the arguments for "IN (...)", skipping
+// duplicate IDs.
+func inClause(ids []int) (string, []interface{}) {
+	seen := make(map[int]bool, len(ids))
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			args = append(args, id)
+		}
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", len(args)), ","), args
+}
+
+type mysqlUsers struct{ q *DB }
+
+func (m mysqlUsers) ByID(id int) (*User, error) {
+	user, err := scanUser(m.q.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrContentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (m mysqlUsers) ByAccountName(name string) (*User, error) {
+	user, err := scanUser(m.q.QueryRow(`SELECT `+userColumns+` FROM users WHERE account_name = ?`, name))
+	if err == sql.ErrNoRows {
+		return nil, ErrContentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (m mysqlUsers) ByEmail(email string) (*User, error) {
+	user, err := scanUser(m.q.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+	if err == sql.ErrNoRows {
+		return nil, ErrContentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (m mysqlUsers) ByIDs(ids []int) ([]User, error) {
+	placeholders, args := inClause(ids)
+	rows, err := m.q.Query(`SELECT `+userColumns+` FROM users WHERE id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]User, 0, len(args))
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+type mysqlAccounts struct{ q *DB }
+
+func (m mysqlAccounts) Credentials(email string) (*User, string, string, error) {
+	var user User
+	var passhash, salt string
+	err := m.q.QueryRow(`SELECT u.id, u.account_name, u.nick_name, u.email, u.passhash, s.salt
+FROM users u
+JOIN salts s ON u.id = s.user_id
+WHERE u.email = ?`, email).Scan(&user.ID, &user.AccountName, &user.NickName, &user.Email, &passhash, &salt)
+	if err == sql.ErrNoRows {
+		return nil, "", "", ErrContentNotFound
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+	return &user, passhash, salt, nil
+}
+
+func (m mysqlAccounts) CredentialsByID(userID int) (string, string, error) {
+	var passhash, salt string
+	err := m.q.QueryRow(`SELECT u.passhash, s.salt FROM users u JOIN salts s ON u.id = s.user_id WHERE u.id = ?`, userID).Scan(&passhash, &salt)
+	if err == sql.ErrNoRows {
+		return "", "", ErrContentNotFound
+	}
+	return passhash, salt, err
+}
+
+func (m mysqlAccounts) SetPasshash(userID int, passhash string) error {
+	_, err := m.q.Exec(`UPDATE users SET passhash = ? WHERE id = ?`, passhash, userID)
+	return err
+}
+
+func (m mysqlAccounts) Rehash(userID int, oldHash, newHash string) error {
+	_, err := m.q.Exec(`UPDATE users SET passhash = ? WHERE id = ? AND passhash = ?`, newHash, userID, oldHash)
+	return err
+}
+
+// Taken checks users before an insert or update. The unique keys of users
+// still decide when two requests race.
+func (m mysqlAccounts) Taken(accountName, email string) error {
+	var n int
+	if accountName != "" {
+		if err := m.q.QueryRow(`SELECT COUNT(1) FROM users WHERE account_name = ?`, accountName).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrAccountNameTaken
+		}
+	}
+	if email != "" {
+		if err := m.q.QueryRow(`SELECT COUNT(1) FROM users WHERE email = ?`, email).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrEmailTaken
+		}
+	}
+	return nil
+}
+
+func (m mysqlAccounts) Create(f SignupForm, salt, passhash string) (int, error) {
+	tx, err := m.q.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO users (account_name, nick_name, email, passhash) VALUES (?,?,?,?)`,
+		f.AccountName, f.NickName, f.Email, passhash)
+	if key, ok := duplicateKey(err); ok {
+		switch key {
+		case "account_name":
+			return 0, ErrAccountNameTaken
+		case "email":
+			return 0, ErrEmailTaken
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO salts (user_id, salt) VALUES (?,?)`, id, salt); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO profiles (user_id, first_name, last_name, sex, birthday, pref) VALUES (?,'','','',NULL,'')`, id)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO email_verifications (user_id, email) VALUES (?,?)`, id, f.Email); err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+func (m mysqlAccounts) SetNickName(userID int, nick string) error {
+	_, err := m.q.Exec(`UPDATE users SET nick_name = ? WHERE id = ?`, nick, userID)
+	return err
+}
+
+func (m mysqlAccounts) Rename(user *User, name string) error {
+	tx, err := m.q.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE users SET account_name = ? WHERE id = ?`, name, user.ID)
+	if isDuplicateKey(err) {
+		return ErrAccountNameTaken
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM account_name_history WHERE old_name = ?`, name); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO account_name_history (old_name, user_id) VALUES (?,?)
+ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), changed_at = CURRENT_TIMESTAMP`, user.AccountName, user.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m mysqlAccounts) RenamedTo(oldName string) (string, error) {
+	var name string
+	err := m.q.QueryRow(`SELECT u.account_name FROM account_name_history h JOIN users u ON u.id = h.user_id WHERE h.old_name = ?`, oldName).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", ErrContentNotFound
+	}
+	return name, err
+}
+
+func (m mysqlAccounts) SetEmail(userID int, email string) error {
+	_, err := m.q.Exec(`UPDATE users SET email = ? WHERE id = ?`, email, userID)
+	if isDuplicateKey(err) {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+	_, err = m.q.Exec(`UPDATE email_verifications SET email = ?, verified_at = NOW() WHERE user_id = ?`, email, userID)
+	return err
+}
+
+// EmailVerified is true for users from the seed data, who have no
+// verification row.
+func (m mysqlAccounts) EmailVerified(userID int) (bool, error) {
+	var verifiedAt mysql.NullTime
+	err := m.q.QueryRow(`SELECT verified_at FROM email_verifications WHERE user_id = ?`, userID).Scan(&verifiedAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return verifiedAt.Valid, nil
+}
+
+func (m mysqlAccounts) VerifyEmail(userID int, email string) error {
+	_, err := m.q.Exec(`UPDATE email_verifications SET verified_at = NOW() WHERE user_id = ? AND email = ? AND verified_at IS NULL`, userID, email)
+	return err
+}
+
+func (m mysqlAccounts) PendingVerification(email string) (int, error) {
+	var userID int
+	err := m.q.QueryRow(`SELECT user_id FROM email_verifications WHERE email = ? AND verified_at IS NULL`, email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrContentNotFound
+	}
+	return userID, err
+}
+
+type mysqlTokens struct{ q *DB }
+
+func (m mysqlTokens) Issue(userID int, purpose, email string, ttl time.Duration) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = m.q.Exec(`INSERT INTO user_tokens (token_hash, user_id, purpose, email, expires_at) VALUES (?,?,?,?, NOW() + INTERVAL ? SECOND)`,
+		sessionKey(token), userID, purpose, email, int(ttl.Seconds()))
+	return token, err
+}
+
+func (m mysqlTokens) Consume(token, purpose string) (int, string, error) {
+	key := sessionKey(token)
+	res, err := m.q.Exec(`UPDATE user_tokens SET used_at = NOW() WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > NOW()`, key, purpose)
+	if err != nil {
+		return 0, "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, "", err
+	} else if n == 0 {
+		return 0, "", ErrInvalidToken
+	}
+	var userID int
+	var email string
+	err = m.q.QueryRow(`SELECT user_id, email FROM user_tokens WHERE token_hash = ?`, key).Scan(&userID, &email)
+	return userID, email, err
+}
+
+type mysqlProfiles struct{ q *DB }
+
+func (m mysqlProfiles) Get(userID int) (Profile, error) {
+	prof, err := scanProfile(m.q.QueryRow(`SELECT `+profileColumns+` FROM profiles WHERE user_id = ?`, userID))
+	if err == sql.ErrNoRows {
+		return Profile{}, nil
+	}
+	return prof, err
+}
+
+func (m mysqlProfiles) Update(userID int, form ProfileForm) error {
+	birthday, _ := parseBirthday(form.Birthday)
+	query := `INSERT INTO profiles (user_id, first_name, last_name, sex, birthday, pref) VALUES (?,?,?,?,?,?)
+ON DUPLICATE KEY UPDATE first_name=VALUES(first_name), last_name=VALUES(last_name), sex=VALUES(sex), birthday=VALUES(birthday), pref=VALUES(pref), updated_at=CURRENT_TIMESTAMP()`
+	_, err := m.q.Exec(query, userID, form.FirstName, form.LastName, form.Sex, birthday, form.Pref)
+	return err
+}
+
+type mysqlEntries struct{ q *DB }
+
+func (m mysqlEntries) Get(id int) (Entry, error) {
+	entry, err := scanEntry(m.q.QueryRow(`SELECT `+entryColumns+` FROM entries WHERE id = ? AND deleted_at IS NULL`, id))
+	if err == sql.ErrNoRows {
+		return Entry{}, ErrContentNotFound
+	}
+	return entry, err
+}
+
+func (m mysqlEntries) ByIDs(ids []int) ([]Entry, error) {
+	placeholders, args := inClause(ids)
+	return m.query(len(args), `SELECT `+entryColumns+` FROM entries WHERE id IN (`+placeholders+`)`, args...)
+}
+
+func (m mysqlEntries) ByUser(userID int, withPrivate bool, limit int) ([]Entry, error) {
+	query := `SELECT ` + entryColumns + ` FROM entries WHERE user_id = ? AND private=0 AND deleted_at IS NULL ORDER BY created_at LIMIT ?`
+	if withPrivate {
+		query = `SELECT ` + entryColumns + ` FROM entries WHERE user_id = ? AND deleted_at IS NULL ORDER BY created_at LIMIT ?`
+	}
+	return m.query(limit, query, userID, limit)
+}
+
+func (m mysqlEntries) List(userID int, withPrivate bool, p PageRequest) ([]Entry, Page, error) {
+	query := `SELECT ` + entryColumns + ` FROM entries WHERE user_id = ? AND private=0 AND deleted_at IS NULL AND `
+	if withPrivate {
+		query = `SELECT ` + entryColumns + ` FROM entries WHERE user_id = ? AND deleted_at IS NULL AND `
+	}
+	cond, args := p.Where("created_at", "id", true)
+	entries, err := m.query(p.Limit+1, query+cond+" "+p.OrderBy("created_at", "id", true), append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	n, page := p.Finish(len(entries),
+		func(i, j int) { entries[i], entries[j] = entries[j], entries[i] },
+		func(i int) Cursor { return Cursor{entries[i].CreatedAt, entries[i].ID} })
+	return entries[:n], page, nil
+}
+
+func (m mysqlEntries) query(size int, query string, args ...interface{}) ([]Entry, error) {
+	rows, err := m.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]Entry, 0, size)
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (m mysqlEntries) Create(userID int, title, content string, isPrivate bool) (int, error) {
+	var private int
+	if isPrivate {
+		private = 1
+	}
+	res, err := m.q.Exec(`INSERT INTO entries (user_id, private, title, content, body) VALUES (?,?,?,?,?)`,
+		userID, private, title, content, entryBody(title, content))
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// Update locks the row, so that concurrent edits each save the version
+// they replaced.
+func (m mysqlEntries) Update(id, userID int, title, content string, isPrivate bool) error {
+	tx, err := m.q.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err := scanEntry(tx.QueryRow(`SELECT `+entryColumns+` FROM entries WHERE id = ? AND deleted_at IS NULL FOR UPDATE`, id))
+	if err == sql.ErrNoRows {
+		return ErrContentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if old.UserID != userID {
+		return ErrPermissionDenied
+	}
+	_, err = tx.Exec(`INSERT INTO entry_revisions (entry_id, private, title, content) VALUES (?,?,?,?)`, id, old.Private, old.Title, old.Content)
+	if err != nil {
+		return err
+	}
+
+	private := 0
+	if isPrivate {
+		private = 1
+	}
+	_, err = tx.Exec(`UPDATE entries SET private = ?, title = ?, content = ?, body = ? WHERE id = ?`,
+		private, title, content, entryBody(title, content), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m mysqlEntries) Delete(id int) error {
+	_, err := m.q.Exec(`UPDATE entries SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?`, id)
+	return err
+}
+
+func (m mysqlEntries) Revisions(id int) ([]EntryRevision, error) {
+	rows, err := m.q.Query(`SELECT id, entry_id, private, title, content, created_at FROM entry_revisions WHERE entry_id = ? ORDER BY id DESC`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := make([]EntryRevision, 0, 10)
+	for rows.Next() {
+		rev := EntryRevision{}
+		var private int
+		if err := rows.Scan(&rev.ID, &rev.EntryID, &private, &rev.Title, &rev.Content, &rev.CreatedAt); err != nil {
+			return nil, err
+		}
+		rev.Private = private == 1
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+func (m mysqlEntries) CommentsLocked(id int) (bool, error) {
+	var locked bool
+	err := m.q.QueryRow(`SELECT comments_locked FROM entries WHERE id = ?`, id).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return false, ErrContentNotFound
+	}
+	return locked, err
+}
+
+func (m mysqlEntries) SetCommentsLocked(id int, locked bool) error {
+	_, err := m.q.Exec(`UPDATE entries SET comments_locked = ? WHERE id = ?`, locked, id)
+	return err
+}
+
+type mysqlComments struct{ q *DB }
+
+func (m mysqlComments) Get(id int) (Comment, error) {
+	c, err := scanComment(m.q.QueryRow(`SELECT `+commentColumns+` FROM comments WHERE id = ? AND deleted_at IS NULL`, id))
+	if err == sql.ErrNoRows {
+		return Comment{}, ErrContentNotFound
+	}
+	return c, err
+}
+
+func (m mysqlComments) List(entryID int, withHidden bool, p PageRequest) ([]Comment, Page, error) {
+	visibility := "hidden = 0 AND "
+	if withHidden {
+		visibility = ""
+	}
+	cond, args := p.Where("created_at", "id", false)
+	rows, err := m.q.Query(`SELECT `+commentColumns+` FROM comments WHERE entry_id = ? AND deleted_at IS NULL AND `+visibility+cond+" "+p.OrderBy("created_at", "id", false),
+		append([]interface{}{entryID}, args...)...)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	comments := make([]Comment, 0, p.Limit+1)
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, Page{}, err
+		}
+		comments = append(comments, c)
+	}
+	rows.Close()
+	n, page := p.Finish(len(comments),
+		func(i, j int) { comments[i], comments[j] = comments[j], comments[i] },
+		func(i int) Cursor { return Cursor{comments[i].CreatedAt, comments[i].ID} })
+	return comments[:n], page, nil
+}
+
+func (m mysqlComments) ForOwner(userID, limit int) ([]Comment, error) {
+	rows, err := m.q.Query(`SELECT `+commentColumnsC+`
+FROM comments c
+JOIN entries e ON c.entry_id = e.id
+WHERE e.user_id = ? AND e.deleted_at IS NULL AND c.hidden = 0 AND c.deleted_at IS NULL
+AND NOT EXISTS (SELECT 1 FROM blocks b WHERE (b.blocker_id = e.user_id AND b.blocked_id = c.user_id) OR (b.blocker_id = c.user_id AND b.blocked_id = e.user_id))
+ORDER BY c.created_at DESC
+LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := make([]Comment, 0, limit)
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+func (m mysqlComments) Count(entryID int) (int, error) {
+	var n int
+	err := m.q.QueryRow(`SELECT COUNT(*) AS c FROM comments WHERE entry_id = ? AND hidden = 0 AND deleted_at IS NULL`, entryID).Scan(&n)
+	return n, err
+}
+
+func (m mysqlComments) Create(entryID, userID int, comment string) (int, error) {
+	res, err := m.q.Exec(`INSERT INTO comments (entry_id, user_id, comment) VALUES (?,?,?)`, entryID, userID, comment)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (m mysqlComments) Delete(id int) error {
+	_, err := m.q.Exec(`UPDATE comments SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?`, id)
+	return err
+}
+
+func (m mysqlComments) SetHidden(id int, hidden bool) error {
+	_, err := m.q.Exec(`UPDATE comments SET hidden = ? WHERE id = ?`, hidden, id)
+	return err
+}
+
+type mysqlRelations struct{ q *DB }
+
+// List reads relations with one = userID only; relations holds both
+// directions of every friendship, so each friend appears once.
+func (m mysqlRelations) List(userID int, p PageRequest) ([]Friend, Page, error) {
+	cond, args := p.Where("created_at", "another", true)
+	rows, err := m.q.Query(`SELECT another, created_at FROM relations WHERE one = ? AND `+cond+" "+p.OrderBy("created_at", "another", true),
+		append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	friends := make([]Friend, 0, p.Limit+1)
+	for rows.Next() {
+		f := Friend{}
+		if err := rows.Scan(&f.ID, &f.CreatedAt); err != nil {
+			rows.Close()
+			return nil, Page{}, err
+		}
+		friends = append(friends, f)
+	}
+	rows.Close()
+	n, page := p.Finish(len(friends),
+		func(i, j int) { friends[i], friends[j] = friends[j], friends[i] },
+		func(i int) Cursor { return Cursor{friends[i].CreatedAt, friends[i].ID} })
+	return friends[:n], page, nil
+}
+
+func (m mysqlRelations) FriendSet(userID int) (map[int]time.Time, error) {
+	rows, err := m.q.Query(`SELECT one, another, created_at FROM relations WHERE one = ? OR another = ?`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	friends := make(map[int]time.Time)
+	for rows.Next() {
+		var one, another int
+		var createdAt time.Time
+		if err := rows.Scan(&one, &another, &createdAt); err != nil {
+			return nil, err
+		}
+		friendID := another
+		if another == userID {
+			friendID = one
+		}
+		if t, ok := friends[friendID]; !ok || createdAt.After(t) {
+			friends[friendID] = createdAt
+		}
+	}
+	return friends, rows.Err()
+}
+
+func (m mysqlRelations) Delete(userID, anotherID int) error {
+	_, err := m.q.Exec(`DELETE FROM relations WHERE (one = ? AND another = ?) OR (one = ? AND another = ?)`, userID, anotherID, anotherID, userID)
+	return err
+}
+
+type mysqlFriendRequests struct{ q *DB }
+
+func (m mysqlFriendRequests) Pending(userID, anotherID int) (string, error) {
+	var requesterID int
+	err := m.q.QueryRow(`SELECT requester_id FROM friend_requests
+WHERE (requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)
+LIMIT 1`, userID, anotherID, anotherID, userID).Scan(&requesterID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if requesterID == userID {
+		return "outgoing", nil
+	}
+	return "incoming", nil
+}
+
+func (m mysqlFriendRequests) Create(requesterID, addresseeID int) error {
+	_, err := m.q.Exec(`INSERT IGNORE INTO friend_requests (requester_id, addressee_id) VALUES (?,?)`, requesterID, addresseeID)
+	return err
+}
+
+func (m mysqlFriendRequests) Accept(requesterID, addresseeID int) error {
+	tx, err := m.q.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM friend_requests WHERE requester_id = ? AND addressee_id = ?`, requesterID, addresseeID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrContentNotFound
+	}
+	_, err = tx.Exec(`INSERT IGNORE INTO relations (one, another) VALUES (?,?), (?,?)`, addresseeID, requesterID, requesterID, addresseeID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m mysqlFriendRequests) Delete(requesterID, addresseeID int) error {
+	res, err := m.q.Exec(`DELETE FROM friend_requests WHERE requester_id = ? AND addressee_id = ?`, requesterID, addresseeID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrContentNotFound
+	}
+	return nil
+}
+
+func (m mysqlFriendRequests) Count(userID int) (int, error) {
+	var n int
+	err := m.q.QueryRow(`SELECT COUNT(*) FROM friend_requests WHERE addressee_id = ?`, userID).Scan(&n)
+	return n, err
+}
+
+func (m mysqlFriendRequests) List(userID int, incoming bool) ([]FriendRequest, error) {
+	query := `SELECT requester_id, created_at FROM friend_requests WHERE addressee_id = ? ORDER BY created_at DESC`
+	if !incoming {
+		query = `SELECT addressee_id, created_at FROM friend_requests WHERE requester_id = ? ORDER BY created_at DESC`
+	}
+	rows, err := m.q.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	requests := make([]FriendRequest, 0, 10)
+	for rows.Next() {
+		fr := FriendRequest{}
+		if err := rows.Scan(&fr.UserID, &fr.CreatedAt); err != nil {
+			return nil, err
+		}
+		requests = append(requests, fr)
+	}
+	return requests, rows.Err()
+}
+
+type mysqlBlocks struct{ q *DB }
+
+func (m mysqlBlocks) Between(userID, anotherID int) (bool, error) {
+	var cnt int
+	err := m.q.QueryRow(`SELECT COUNT(1) FROM blocks
+WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)`, userID, anotherID, anotherID, userID).Scan(&cnt)
+	return cnt > 0, err
+}
+
+func (m mysqlBlocks) Create(userID, anotherID int) error {
+	tx, err := m.q.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT IGNORE INTO blocks (blocker_id, blocked_id) VALUES (?,?)`, userID, anotherID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM relations WHERE (one = ? AND another = ?) OR (one = ? AND another = ?)`, userID, anotherID, anotherID, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM friend_requests WHERE (requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)`, userID, anotherID, anotherID, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m mysqlBlocks) Delete(userID, anotherID int) error {
+	_, err := m.q.Exec(`DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?`, userID, anotherID)
+	return err
+}
+
+func (m mysqlBlocks) List(userID int) ([]Block, error) {
+	rows, err := m.q.Query(`SELECT blocked_id, created_at FROM blocks WHERE blocker_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocks := make([]Block, 0, 10)
+	for rows.Next() {
+		b := Block{}
+		if err := rows.Scan(&b.UserID, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, rows.Err()
+}
+
+type mysqlFootprints struct{ q *DB }
+
+func (m mysqlFootprints) Add(userID, ownerID int) error {
+	_, err := m.q.Exec(`INSERT INTO footprints (user_id,owner_id) VALUES (?,?)`, userID, ownerID)
+	return err
+}
+
+// List is keyed on (updated, owner_id).
+func (m mysqlFootprints) List(userID int, p PageRequest) ([]Footprint, Page, error) {
+	footprints := make([]Footprint, 0, p.Limit+1)
+	cond, args := p.Where("updated", "owner_id", true)
+	rows, err := m.q.Query(`SELECT user_id, owner_id, DATE(created_at) AS date, MAX(created_at) as updated
+FROM footprints
+WHERE user_id = ?
+GROUP BY user_id, owner_id, DATE(created_at)
+HAVING `+cond+`
+`+p.OrderBy("updated", "owner_id", true), append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	for rows.Next() {
+		fp := Footprint{}
+		if err := rows.Scan(&fp.UserID, &fp.OwnerID, &fp.CreatedAt, &fp.Updated); err != nil {
+			rows.Close()
+			return nil, Page{}, err
+		}
+		footprints = append(footprints, fp)
+	}
+	rows.Close()
+	n, page := p.Finish(len(footprints),
+		func(i, j int) { footprints[i], footprints[j] = footprints[j], footprints[i] },
+		func(i int) Cursor { return Cursor{footprints[i].Updated, footprints[i].OwnerID} })
+	return footprints[:n], page, nil
+}
+
+// mysqlTimeline runs the queries of timeline.go, which -rebuild-timeline
+// shares.
+type mysqlTimeline struct{ q *DB }
+
+func (m mysqlTimeline) AddEntry(entryID int) error {
+	return fanOutEntry(m.q, entryID)
+}
+
+func (m mysqlTimeline) AddComment(commentID int) error {
+	return fanOutComment(m.q, commentID)
+}
+
+func (m mysqlTimeline) Backfill(userID, friendID int) error {
+	return backfillTimeline(m.q, userID, friendID)
+}
+
+func (m mysqlTimeline) DropBetween(userID, anotherID int) error {
+	return dropTimelineBetween(m.q, userID, anotherID)
+}
+
+func (m mysqlTimeline) Entries(userID, limit int) ([]Entry, error) {
+	return loadTimelineEntries(m.q, userID, limit)
+}
+
+func (m mysqlTimeline) Comments(userID, limit int) ([]Comment, error) {
+	return loadTimelineComments(m.q, userID, limit)
+}
+
+type mysqlLogins struct{ q *DB }
+
+func (m mysqlLogins) Record(userID int, email, ip string, succeeded bool) error {
+	var uid interface{}
+	if userID != 0 {
+		uid = userID
+	}
+	_, err := m.q.Exec(`INSERT INTO login_attempts (user_id, email, remote_addr, succeeded) VALUES (?,?,?,?)`,
+		uid, truncate(email, 255), truncate(ip, 64), succeeded)
+	return err
+}
+
+func (m mysqlLogins) Recent(email string, limit int) ([]LoginAttempt, error) {
+	return m.query(limit, `SELECT remote_addr, created_at, succeeded FROM login_attempts WHERE email = ? ORDER BY created_at DESC, id DESC LIMIT ?`, truncate(email, 255), limit)
+}
+
+func (m mysqlLogins) Failed(userID, limit int) ([]LoginAttempt, error) {
+	return m.query(limit, `SELECT remote_addr, created_at, succeeded FROM login_attempts
+WHERE user_id = ? AND succeeded = 0 AND created_at > NOW() - INTERVAL 30 DAY
+ORDER BY id DESC LIMIT ?`, userID, limit)
+}
+
+func (m mysqlLogins) ResetLockout(email string) error {
+	_, err := m.q.Exec(`INSERT INTO lockout_resets (email) VALUES (?) ON DUPLICATE KEY UPDATE reset_at = CURRENT_TIMESTAMP`, truncate(email, 255))
+	return err
+}
+
+func (m mysqlLogins) LockoutReset(email string) (time.Time, error) {
+	var at time.Time
+	err := m.q.QueryRow(`SELECT reset_at FROM lockout_resets WHERE email = ?`, truncate(email, 255)).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
+
+func (m mysqlLogins) query(size int, query string, args ...interface{}) ([]LoginAttempt, error) {
+	rows, err := m.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attempts := make([]LoginAttempt, 0, size)
+	for rows.Next() {
+		a := LoginAttempt{}
+		if err := rows.Scan(&a.RemoteAddr, &a.CreatedAt, &a.Succeeded); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+type mysqlAdmin struct{ q *DB }
+
+// Initialize puts the initial data back as it was. Entries, comments and
+// footprints of the initial data have the lowest IDs, and are reset to
+// their first version; users, profiles and relations are put back from the
+// copies migration 13 made.
+func (m mysqlAdmin) Initialize() error {
+	for _, query := range []string{
+		"DELETE FROM relations WHERE id > 500000",
+		"DELETE FROM friend_requests",
+		"DELETE FROM blocks",
+		"DELETE FROM footprints WHERE id > 500000",
+		"DELETE FROM entries WHERE id > 500000",
+		"DELETE FROM comments WHERE id > 1500000",
+		"DELETE FROM timeline WHERE entry_id > 500000 OR comment_id > 1500000 OR user_id NOT IN (SELECT id FROM initial_users)",
+		"DELETE FROM login_attempts",
+		"DELETE FROM lockout_resets",
+		"DELETE FROM user_tokens",
+		"DELETE FROM email_verifications",
+		"DELETE FROM account_name_history",
+		"DELETE FROM salts WHERE user_id NOT IN (SELECT id FROM initial_users)",
+		"DELETE FROM users WHERE id NOT IN (SELECT id FROM initial_users)",
+		// Renamed users are moved out of the way first, so that putting
+		// the names back cannot collide with a name taken in between.
+		`UPDATE users u JOIN initial_users i ON i.id = u.id
+SET u.account_name = CONCAT('#', u.id), u.email = CONCAT('#', u.id)
+WHERE BINARY u.account_name <> BINARY i.account_name OR BINARY u.email <> BINARY i.email`,
+		`UPDATE users u JOIN initial_users i ON i.id = u.id
+SET u.account_name = i.account_name, u.nick_name = i.nick_name, u.email = i.email, u.passhash = i.passhash`,
+		"DELETE FROM profiles",
+		"INSERT INTO profiles SELECT * FROM initial_profiles",
+		`UPDATE entries e
+JOIN (SELECT entry_id, MIN(id) AS id FROM entry_revisions GROUP BY entry_id) f ON f.entry_id = e.id
+JOIN entry_revisions r ON r.id = f.id
+SET e.private = r.private, e.title = r.title, e.content = r.content, e.body = CONCAT(r.title, '\n', r.content)`,
+		"DELETE FROM entry_revisions",
+		"UPDATE entries SET deleted_at = NULL, comments_locked = 0 WHERE deleted_at IS NOT NULL OR comments_locked = 1",
+		"UPDATE comments SET deleted_at = NULL, hidden = 0 WHERE deleted_at IS NOT NULL OR hidden = 1",
+	} {
+		if _, err := m.q.Exec(query); err != nil {
+			return err
+		}
+	}
+	return m.restoreRelations()
+}
+
+// restoreRelations puts back the relations of the initial data which
+// unfriending or blocking removed, with the timeline items they bring.
+func (m mysqlAdmin) restoreRelations() error {
+	rows, err := m.q.Query(`SELECT r.one, r.another FROM initial_relations r
+LEFT JOIN relations x ON x.id = r.id
+WHERE x.id IS NULL`)
+	if err != nil {
+		return err
+	}
+	type pair struct{ one, another int }
+	missing := make([]pair, 0)
+	for rows.Next() {
+		var p pair
+		if err := rows.Scan(&p.one, &p.another); err != nil {
+			rows.Close()
+			return err
+		}
+		missing = append(missing, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if _, err := m.q.Exec(`INSERT IGNORE INTO relations SELECT * FROM initial_relations`); err != nil {
+		return err
+	}
+	for _, p := range missing {
+		if err := backfillTimeline(m.q, p.one, p.another); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// requestState is what the app keeps about one request while serving it:
+// its ID, its query stats, the current user and what is cached for it.
+// accessLog puts it on the request context before routing, so that it is
+// shared by the copies of the request which mux hands to the handlers, and
+// it goes away with the request.
+type requestState struct {
+	id      string
+	queries QueryStats
+	user    *User
+
+	repoSource RepoSource
+	repos      *Repos
+	loader     *Loader
+	csrfToken  string
+}
+
+type stateKey struct{}
+
+// withState returns r with a new requestState on its context, or r itself
+// if it already has one.
+func withState(r *http.Request) (*http.Request, *requestState) {
+	if st, ok := r.Context().Value(stateKey{}).(*requestState); ok {
+		return r, st
+	}
+	st := &requestState{id: newRequestID()}
+	return r.WithContext(context.WithValue(r.Context(), stateKey{}, st)), st
+}
+
+// stateOf returns the state of the request. A request which went through
+// neither accessLog nor serve gets a new state on every call, which caches
+// nothing.
+func stateOf(r *http.Request) *requestState {
+	if st, ok := r.Context().Value(stateKey{}).(*requestState); ok {
+		return st
+	}
+	return &requestState{id: "-"}
+}
@@ -0,0 +1,775 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The tests below serve the whole site on a MemoryStore and drive it over
+// HTTP like a browser or an API client would. TestMain checks that they
+// have called every route and rendered every page between them, as the
+// methods pages call on pageView are only checked when they run.
+
+var (
+	routesMu  sync.Mutex
+	routesHit = make(map[string]bool) // route template and method
+	routes    *mux.Router
+)
+
+func TestMain(m *testing.M) {
+	routes = mux.NewRouter()
+	AttachAdmin(routes)
+	AttachSite(routes)
+	eventLog.SetOutput(ioutil.Discard)
+
+	code := m.Run()
+	if code == 0 && flag.Lookup("test.run").Value.String() == "" {
+		if missed := missedRoutes(); len(missed) > 0 {
+			fmt.Fprintf(os.Stderr, "routes not covered by the tests:\n\t%s\n", strings.Join(missed, "\n\t"))
+			code = 1
+		}
+		if missed := missedPages(); len(missed) > 0 {
+			fmt.Fprintf(os.Stderr, "pages not rendered by the tests:\n\t%s\n", strings.Join(missed, "\n\t"))
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+// missedRoutes lists the routes with a handler which no test has called.
+func missedRoutes() []string {
+	var missed []string
+	routes.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"*"}
+		}
+		for _, m := range methods {
+			if !routesHit[tpl+" "+m] {
+				missed = append(missed, m+" "+tpl)
+			}
+		}
+		return nil
+	})
+	sort.Strings(missed)
+	return missed
+}
+
+// missedPages lists the pages which no test has rendered.
+func missedPages() []string {
+	files, _ := filepath.Glob("templates/*.html")
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	var missed []string
+	for _, f := range files {
+		name := filepath.Base(f)
+		if !isPartial(name) && metrics.renders[labels("template", name)] == nil {
+			missed = append(missed, name)
+		}
+	}
+	return missed
+}
+
+type testSite struct {
+	t      *testing.T
+	store  *MemoryStore
+	server *httptest.Server
+	mail   bytes.Buffer
+
+	alice, bob, carol User
+}
+
+const testPassword = "correct horse"
+
+// newTestSite sets up the globals main would and serves NewServer on a
+// store with the users alice, bob and carol, where alice and bob are
+// friends. The caller closes its server.
+func newTestSite(t *testing.T) *testSite {
+	s := &testSite{t: t, store: NewMemoryStore()}
+	store = NewServerStore(NewMemorySessionBackend(), 168*time.Hour, 720*time.Hour)
+	friendCache = NewFriendCache(1000)
+	loginLimiter = NewLoginLimiter()
+	mailLimiter = NewLoginLimiter()
+	mailer = &WriterMailer{W: &s.mail}
+	adminToken = "secret"
+	var err error
+	if adminAllow, err = parseAllowlist("127.0.0.1/8,::1"); err != nil {
+		t.Fatal(err)
+	}
+	if templates, err = NewTemplateRegistry("templates"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.alice = s.addUser("alice", "Alice")
+	s.bob = s.addUser("bob", "Bob")
+	s.carol = s.addUser("carol", "Carol")
+	s.store.AddFriends(s.alice.ID, s.bob.ID)
+	s.store.MarkInitial()
+
+	site := NewServer(s.store.Repos, true)
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routesMu.Lock()
+		routesHit[routeTemplate(routes, r)+" "+r.Method] = true
+		routesHit[routeTemplate(routes, r)+" *"] = true
+		routesMu.Unlock()
+		site.ServeHTTP(w, r)
+	}))
+	return s
+}
+
+func (s *testSite) addUser(name, nick string) User {
+	u := s.store.AddUser(name, nick, name+"@example.com")
+	if err := s.store.SetPassword(u.ID, testPassword); err != nil {
+		s.t.Fatal(err)
+	}
+	return u
+}
+
+var mailTokenPattern = regexp.MustCompile(`token=([0-9a-f]+)`)
+
+// lastToken returns the token of the last mail sent.
+func (s *testSite) lastToken() string {
+	m := mailTokenPattern.FindAllStringSubmatch(s.mail.String(), -1)
+	if len(m) == 0 {
+		s.t.Fatal("no token has been mailed")
+	}
+	return m[len(m)-1][1]
+}
+
+// testClient is a browser with its own cookies. It keeps the CSRF token of
+// the last form it was shown and sends it with every form it posts.
+type testClient struct {
+	site *testSite
+	http *http.Client
+	csrf string
+}
+
+var csrfPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+func (s *testSite) client() *testClient {
+	jar, _ := cookiejar.New(nil)
+	return &testClient{site: s, http: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// loggedIn returns a client logged in as the user.
+func (s *testSite) loggedIn(u User) *testClient {
+	c := s.client()
+	c.expect(http.StatusOK, "GET", "/login")
+	c.expectForm(http.StatusSeeOther, "/login", url.Values{"email": {u.Email}, "password": {testPassword}})
+	c.expect(http.StatusOK, "GET", "/settings")
+	return c
+}
+
+func (c *testClient) do(req *http.Request) (*http.Response, string) {
+	t := c.site.t
+	t.Helper()
+	res, err := c.http.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := csrfPattern.FindSubmatch(b); m != nil {
+		c.csrf = string(m[1])
+	}
+	return res, string(b)
+}
+
+func (c *testClient) request(method, path, contentType string, body io.Reader) *http.Request {
+	req, err := http.NewRequest(method, c.site.server.URL+path, body)
+	if err != nil {
+		c.site.t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req
+}
+
+func (c *testClient) check(status int, req *http.Request) (*http.Response, string) {
+	c.site.t.Helper()
+	res, body := c.do(req)
+	if res.StatusCode != status {
+		c.site.t.Fatalf("%s %s: got %d, want %d\n%s", req.Method, req.URL.Path, res.StatusCode, status, body)
+	}
+	return res, body
+}
+
+// expect sends a request without a body.
+func (c *testClient) expect(status int, method, path string) (*http.Response, string) {
+	c.site.t.Helper()
+	return c.check(status, c.request(method, path, "", nil))
+}
+
+// expectForm posts the form with the CSRF token.
+func (c *testClient) expectForm(status int, path string, form url.Values) (*http.Response, string) {
+	c.site.t.Helper()
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set(csrfFieldName, c.csrf)
+	return c.check(status, c.request("POST", path, "application/x-www-form-urlencoded", strings.NewReader(form.Encode())))
+}
+
+// expectJSON sends v as a JSON body and decodes the response into out, if
+// it is not nil.
+func (c *testClient) expectJSON(status int, method, path string, v, out interface{}) {
+	c.site.t.Helper()
+	var body io.Reader
+	if v != nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			c.site.t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+	}
+	_, res := c.check(status, c.request(method, path, "application/json", body))
+	if out != nil {
+		if err := json.Unmarshal([]byte(res), out); err != nil {
+			c.site.t.Fatalf("%s %s: %s\n%s", method, path, err, res)
+		}
+	}
+}
+
+// expectRedirect checks where a response sends the browser.
+func expectRedirect(t *testing.T, res *http.Response, location string) {
+	t.Helper()
+	if got := res.Header.Get("Location"); got != location {
+		t.Fatalf("redirected to %q, want %q", got, location)
+	}
+}
+
+// newEntry posts an entry as the client and returns its ID.
+func (c *testClient) newEntry(title string, private bool) int {
+	c.site.t.Helper()
+	var res struct {
+		Entry Entry `json:"entry"`
+	}
+	c.expectJSON(http.StatusCreated, "POST", "/api/v1/entries", map[string]interface{}{"title": title, "content": title + " content", "private": private}, &res)
+	return res.Entry.ID
+}
+
+func TestSignupAndLogin(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	c := s.client()
+
+	c.expect(http.StatusFound, "GET", "/")
+	c.expect(http.StatusOK, "GET", "/signup")
+	signup := url.Values{"account_name": {"dave"}, "nick_name": {"Dave"}, "email": {"dave@example.com"}, "password": {"dave's password"}}
+	c.expectForm(http.StatusOK, "/signup", signup)
+	c.expectForm(http.StatusConflict, "/signup", signup)
+	signup.Set("password", strings.Repeat("a", maxPasswordBytes+1))
+	c.expectForm(http.StatusBadRequest, "/signup", signup)
+
+	c.expect(http.StatusOK, "GET", "/login")
+	login := url.Values{"email": {"dave@example.com"}, "password": {"dave's password"}}
+	c.expectForm(http.StatusForbidden, "/login", login)
+	c.expectForm(http.StatusOK, "/verify/resend", url.Values{"email": {"dave@example.com"}})
+	c.expect(http.StatusBadRequest, "GET", "/verify?token=0123")
+	c.expect(http.StatusOK, "GET", "/verify?token="+s.lastToken())
+
+	c.expect(http.StatusOK, "GET", "/login")
+	c.expectForm(http.StatusUnauthorized, "/login", url.Values{"email": {"dave@example.com"}, "password": {"wrong"}})
+	res, _ := c.expectForm(http.StatusSeeOther, "/login", login)
+	expectRedirect(t, res, "/")
+	_, body := c.expect(http.StatusOK, "GET", "/")
+	if !strings.Contains(body, "Dave") {
+		t.Errorf("index does not greet the new user:\n%s", body)
+	}
+
+	c.expectForm(http.StatusSeeOther, "/logout", nil)
+	c.expect(http.StatusFound, "GET", "/")
+}
+
+// TestAnonymousSessions checks that visitors get a session only with a
+// form, and that such a session expires sooner than one with a user.
+func TestAnonymousSessions(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	backend := store.Backend.(*MemorySessionBackend)
+	count := func() int {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		return len(backend.recs)
+	}
+
+	c := s.client()
+	c.expect(http.StatusFound, "GET", "/")
+	c.expectJSON(http.StatusUnauthorized, "GET", "/api/v1/dashboard", nil, nil)
+	c.expect(http.StatusNotFound, "GET", "/css/missing.css")
+	if n := count(); n != 0 {
+		t.Fatalf("%d sessions after anonymous page views, want 0", n)
+	}
+	c.expect(http.StatusOK, "GET", "/login")
+	c.expect(http.StatusOK, "GET", "/signup")
+	if n := count(); n != 1 {
+		t.Fatalf("%d sessions after showing forms, want 1", n)
+	}
+
+	now := time.Now()
+	idle := &SessionRecord{CreatedAt: now.Add(-2 * time.Hour), LastSeenAt: now.Add(-2 * time.Hour)}
+	if !store.expired(idle, now) {
+		t.Error("anonymous session idle for 2h has not expired")
+	}
+	idle.UserID = s.alice.ID
+	if store.expired(idle, now) {
+		t.Error("session of alice idle for 2h has expired")
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	c := s.loggedIn(s.alice)
+
+	form := url.Values{"title": {"forged"}, "content": {"forged"}}
+	c.check(http.StatusForbidden, c.request("POST", "/diary/entry", "application/x-www-form-urlencoded", strings.NewReader(form.Encode())))
+	c.check(http.StatusForbidden, c.request("POST", "/diary/entry", "text/plain", strings.NewReader(form.Encode())))
+	c.check(http.StatusForbidden, c.request("POST", "/diary/entry", "", strings.NewReader(form.Encode())))
+	c.check(http.StatusForbidden, c.request("POST", "/api/v1/friends/carol", "", nil))
+	c.check(http.StatusForbidden, c.request("POST", "/api/v1/entries", "text/plain", strings.NewReader(`{"title":"forged"}`)))
+	c.check(http.StatusUnsupportedMediaType, c.request("PUT", "/api/v1/users/alice/profile", "text/plain", strings.NewReader(`{"first_name":"forged"}`)))
+	c.expectForm(http.StatusSeeOther, "/diary/entry", form)
+
+	res, _ := s.client().expect(http.StatusOK, "GET", "/login")
+	if cookie := res.Header.Get("Set-Cookie"); !strings.Contains(cookie, "SameSite=Lax") {
+		t.Errorf("session cookie is not SameSite=Lax: %s", cookie)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	defer func(n int) { lockoutThreshold = n }(lockoutThreshold)
+	lockoutThreshold = 3
+	loginLimiter.EmailFree, loginLimiter.IPFree = 100, 100
+	c := s.client()
+	c.expect(http.StatusOK, "GET", "/login")
+
+	// An address without an account locks like one with an account.
+	for _, email := range []string{s.alice.Email, "nobody@example.com"} {
+		for i := 0; i < lockoutThreshold; i++ {
+			c.expectForm(http.StatusUnauthorized, "/login", url.Values{"email": {email}, "password": {"wrong"}})
+		}
+		c.expectForm(http.StatusTooManyRequests, "/login", url.Values{"email": {email}, "password": {testPassword}})
+	}
+
+	c.expect(http.StatusOK, "GET", "/password/forgot")
+	c.expectForm(http.StatusOK, "/password/forgot", url.Values{"email": {s.alice.Email}})
+	token := s.lastToken()
+	c.expect(http.StatusOK, "GET", "/password/reset?token="+token)
+	c.expectForm(http.StatusOK, "/password/reset", url.Values{"token": {token}, "password": {"a new password"}})
+	for _, l := range s.store.logins {
+		if l.Succeeded {
+			t.Errorf("the reset was recorded as a login: %+v", l)
+		}
+	}
+	c.expect(http.StatusOK, "GET", "/login")
+	c.expectForm(http.StatusSeeOther, "/login", url.Values{"email": {s.alice.Email}, "password": {"a new password"}})
+}
+
+// TestMailLimits checks that the forms which mail an address are limited
+// whether or not it has an account, and that they do not slow down logins
+// to it.
+func TestMailLimits(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	c := s.client()
+
+	c.expect(http.StatusOK, "GET", "/password/forgot")
+	for _, email := range []string{s.alice.Email, "nobody@example.com"} {
+		for i := 0; i <= mailLimiter.EmailFree; i++ {
+			c.expectForm(http.StatusOK, "/password/forgot", url.Values{"email": {email}})
+		}
+		c.expectForm(http.StatusTooManyRequests, "/password/forgot", url.Values{"email": {email}})
+		c.expectForm(http.StatusTooManyRequests, "/verify/resend", url.Values{"email": {email}})
+	}
+
+	if wait := loginLimiter.Wait(s.alice.Email, "127.0.0.1"); wait > 0 {
+		t.Errorf("mails made logins wait %s", wait)
+	}
+	c.expect(http.StatusOK, "GET", "/login")
+	c.expectForm(http.StatusUnauthorized, "/login", url.Values{"email": {s.alice.Email}, "password": {"wrong"}})
+	c.expectForm(http.StatusSeeOther, "/login", url.Values{"email": {s.alice.Email}, "password": {testPassword}})
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	c := s.client()
+
+	c.expect(http.StatusOK, "GET", "/password/forgot")
+	c.expectForm(http.StatusOK, "/password/forgot", url.Values{"email": {s.alice.Email}})
+	token := s.lastToken()
+	c.expect(http.StatusOK, "GET", "/password/reset?token="+token)
+	c.expectForm(http.StatusOK, "/password/reset", url.Values{"token": {token}, "password": {"a new password"}})
+	c.expectForm(http.StatusBadRequest, "/password/reset", url.Values{"token": {token}, "password": {"another password"}})
+
+	c.expect(http.StatusOK, "GET", "/login")
+	c.expectForm(http.StatusUnauthorized, "/login", url.Values{"email": {s.alice.Email}, "password": {testPassword}})
+	c.expectForm(http.StatusSeeOther, "/login", url.Values{"email": {s.alice.Email}, "password": {"a new password"}})
+}
+
+func TestProfileAndSettings(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	alice := s.loggedIn(s.alice)
+	bob := s.loggedIn(s.bob)
+
+	alice.expect(http.StatusOK, "GET", "/profile/alice")
+	alice.expectForm(http.StatusBadRequest, "/profile/alice", url.Values{"birthday": {"1800-01-01"}})
+	alice.expectForm(http.StatusSeeOther, "/profile/alice", url.Values{"first_name": {"Alice"}, "pref": {"東京都"}})
+	bob.expectForm(http.StatusForbidden, "/profile/alice", url.Values{"first_name": {"Bob"}})
+	_, body := bob.expect(http.StatusOK, "GET", "/profile/alice")
+	if !strings.Contains(body, "東京都") {
+		t.Errorf("profile was not saved:\n%s", body)
+	}
+	alice.expect(http.StatusOK, "GET", "/footprints")
+
+	alice.expect(http.StatusOK, "GET", "/settings")
+	alice.expectForm(http.StatusSeeOther, "/settings/nick_name", url.Values{"nick_name": {"Ally"}})
+	alice.expectForm(http.StatusConflict, "/settings/account_name", url.Values{"account_name": {"bob"}})
+	alice.expectForm(http.StatusSeeOther, "/settings/account_name", url.Values{"account_name": {"ally"}})
+	res, _ := bob.expect(http.StatusFound, "GET", "/profile/alice")
+	expectRedirect(t, res, "/profile/ally")
+
+	alice.expectForm(http.StatusForbidden, "/settings/email", url.Values{"email": {"ally@example.com"}, "password": {"wrong"}})
+	alice.expectForm(http.StatusSeeOther, "/settings/email", url.Values{"email": {"ally@example.com"}, "password": {testPassword}})
+	alice.expect(http.StatusOK, "GET", "/settings/email/confirm?token="+s.lastToken())
+	if u, _ := s.store.Repos(nil).Users.ByID(s.alice.ID); u.Email != "ally@example.com" {
+		t.Errorf("email is %q after confirming", u.Email)
+	}
+
+	alice.expectForm(http.StatusSeeOther, "/settings/password", url.Values{"password": {testPassword}, "new_password": {"a new password"}})
+	alice.expectForm(http.StatusSeeOther, "/logout/all", nil)
+	alice.expect(http.StatusFound, "GET", "/settings")
+}
+
+func TestEntriesAndModeration(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	alice := s.loggedIn(s.alice)
+	bob := s.loggedIn(s.bob)
+	carol := s.loggedIn(s.carol)
+
+	alice.expectForm(http.StatusSeeOther, "/diary/entry", url.Values{"title": {"first"}, "content": {"hello"}})
+	alice.expectForm(http.StatusSeeOther, "/diary/entry", url.Values{"title": {"secret"}, "content": {"for friends"}, "private": {"1"}})
+	_, body := carol.expect(http.StatusOK, "GET", "/diary/entries/alice")
+	if !strings.Contains(body, "first") || strings.Contains(body, "secret") {
+		t.Errorf("entries of alice as seen by carol:\n%s", body)
+	}
+	_, body = bob.expect(http.StatusOK, "GET", "/")
+	if !strings.Contains(body, "secret") {
+		t.Errorf("timeline of bob misses the private entry of alice:\n%s", body)
+	}
+
+	id := alice.newEntry("draft", true)
+	path := "/diary/entry/" + strconv.Itoa(id)
+	carol.expect(http.StatusForbidden, "GET", path)
+	bob.expect(http.StatusOK, "GET", path)
+	alice.expect(http.StatusOK, "GET", path+"/edit")
+	bob.expect(http.StatusForbidden, "GET", path+"/edit")
+	res, _ := alice.expectForm(http.StatusSeeOther, path, url.Values{"title": {"final"}, "content": {"edited"}})
+	expectRedirect(t, res, path)
+	bob.expectForm(http.StatusForbidden, path, url.Values{"title": {"hijacked"}})
+	// The redirect is built from the parsed ID, not from the path.
+	res, _ = alice.expectForm(http.StatusSeeOther, "/diary/entry/0"+strconv.Itoa(id), url.Values{"title": {"final"}, "content": {"edited again"}})
+	expectRedirect(t, res, path)
+	alice.expectForm(http.StatusNotFound, "/diary/entry/x", url.Values{"title": {"final"}})
+	_, body = alice.expect(http.StatusOK, "GET", path+"/history")
+	if !strings.Contains(body, "draft") {
+		t.Errorf("history misses the first version:\n%s", body)
+	}
+	alice.expect(http.StatusNotFound, "GET", "/diary/entry/x")
+
+	bob.expectForm(http.StatusSeeOther, "/diary/comment/"+strconv.Itoa(id), url.Values{"comment": {"nice"}})
+	comments, _, _ := s.store.Repos(nil).Comments.List(id, true, PageRequest{Limit: 10})
+	if len(comments) != 1 {
+		t.Fatalf("got %d comments, want 1", len(comments))
+	}
+	comment := "/diary/comments/" + strconv.Itoa(comments[0].ID)
+	bob.expectForm(http.StatusForbidden, comment+"/hide", nil)
+	alice.expectForm(http.StatusSeeOther, comment+"/hide", nil)
+	if _, body = bob.expect(http.StatusOK, "GET", path); strings.Contains(body, "nice") {
+		t.Errorf("hidden comment shown to bob:\n%s", body)
+	}
+	if _, body = alice.expect(http.StatusOK, "GET", path); !strings.Contains(body, "nice") {
+		t.Errorf("hidden comment not shown to the owner:\n%s", body)
+	}
+	alice.expectForm(http.StatusSeeOther, comment+"/unhide", nil)
+	if _, body = bob.expect(http.StatusOK, "GET", path); !strings.Contains(body, "nice") {
+		t.Errorf("unhidden comment not shown to bob:\n%s", body)
+	}
+
+	alice.expectForm(http.StatusSeeOther, path+"/lock", nil)
+	bob.expectForm(http.StatusForbidden, "/diary/comment/"+strconv.Itoa(id), url.Values{"comment": {"locked out"}})
+	alice.expectForm(http.StatusSeeOther, path+"/unlock", nil)
+	bob.expectForm(http.StatusSeeOther, comment+"/delete", nil)
+
+	bob.expectForm(http.StatusForbidden, path+"/delete", nil)
+	alice.expectForm(http.StatusSeeOther, path+"/delete", nil)
+	alice.expect(http.StatusNotFound, "GET", path)
+}
+
+func TestFriendsAndBlocks(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	alice := s.loggedIn(s.alice)
+	bob := s.loggedIn(s.bob)
+	carol := s.loggedIn(s.carol)
+
+	carol.expectForm(http.StatusSeeOther, "/friends/alice", nil)
+	carol.expectForm(http.StatusSeeOther, "/friends/requests/alice/cancel", nil)
+	carol.expectForm(http.StatusNotFound, "/friends/requests/alice/cancel", nil)
+	carol.expectForm(http.StatusSeeOther, "/friends/alice", nil)
+	_, body := alice.expect(http.StatusOK, "GET", "/friends/requests")
+	if !strings.Contains(body, "carol") {
+		t.Errorf("request of carol is missing:\n%s", body)
+	}
+	alice.expectForm(http.StatusSeeOther, "/friends/requests/carol/decline", nil)
+	carol.expectForm(http.StatusSeeOther, "/friends/alice", nil)
+	alice.expectForm(http.StatusSeeOther, "/friends/requests/carol/accept", nil)
+	_, body = carol.expect(http.StatusOK, "GET", "/friends")
+	if !strings.Contains(body, "alice") {
+		t.Errorf("alice is not a friend of carol:\n%s", body)
+	}
+	alice.expectForm(http.StatusSeeOther, "/friends/carol/unfriend", nil)
+
+	bob.expectForm(http.StatusSeeOther, "/blocks/alice", nil)
+	_, body = bob.expect(http.StatusOK, "GET", "/blocks")
+	if !strings.Contains(body, "alice") {
+		t.Errorf("alice is not blocked:\n%s", body)
+	}
+	alice.expect(http.StatusForbidden, "GET", "/profile/bob")
+	alice.expectForm(http.StatusForbidden, "/friends/bob", nil)
+	bob.expectForm(http.StatusSeeOther, "/blocks/alice/delete", nil)
+	alice.expect(http.StatusOK, "GET", "/profile/bob")
+	_, body = alice.expect(http.StatusOK, "GET", "/friends")
+	if strings.Contains(body, "bob") {
+		t.Errorf("bob is still a friend of alice after blocking:\n%s", body)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	alice := s.client()
+	bob := s.loggedIn(s.bob)
+	carol := s.loggedIn(s.carol)
+
+	alice.expectJSON(http.StatusUnauthorized, "GET", "/api/v1/dashboard", nil, nil)
+	alice.expectJSON(http.StatusUnauthorized, "POST", "/api/v1/login", map[string]string{"email": s.alice.Email, "password": "wrong"}, nil)
+	alice.expectJSON(http.StatusOK, "POST", "/api/v1/login", map[string]string{"email": s.alice.Email, "password": testPassword}, nil)
+
+	alice.expectJSON(http.StatusOK, "GET", "/api/v1/users/alice/profile", nil, nil)
+	alice.expectJSON(http.StatusOK, "PUT", "/api/v1/users/alice/profile", map[string]string{"first_name": "Alice"}, nil)
+	alice.expectJSON(http.StatusBadRequest, "PUT", "/api/v1/users/alice/profile", map[string]string{"sex": "?"}, nil)
+
+	id := alice.newEntry("api", false)
+	entry := "/api/v1/entries/" + strconv.Itoa(id)
+	var edited struct {
+		Entry Entry `json:"entry"`
+	}
+	alice.expectJSON(http.StatusOK, "PUT", "/api/v1/entries/+"+strconv.Itoa(id), map[string]interface{}{"title": "api edited", "content": "edited"}, &edited)
+	if edited.Entry.ID != id {
+		t.Errorf("edited entry %d, want %d", edited.Entry.ID, id)
+	}
+	alice.expectJSON(http.StatusNotFound, "PUT", "/api/v1/entries/x", map[string]interface{}{"title": "x"}, nil)
+	var revisions struct {
+		Revisions []EntryRevision `json:"revisions"`
+	}
+	alice.expectJSON(http.StatusOK, "GET", entry+"/revisions", nil, &revisions)
+	if len(revisions.Revisions) != 1 {
+		t.Errorf("got %d revisions, want 1", len(revisions.Revisions))
+	}
+	var entries struct {
+		Entries []Entry `json:"entries"`
+	}
+	carol.expectJSON(http.StatusOK, "GET", "/api/v1/users/alice/entries", nil, &entries)
+	if len(entries.Entries) != 1 || entries.Entries[0].Title != "api edited" {
+		t.Errorf("entries of alice: %+v", entries.Entries)
+	}
+
+	var comment struct {
+		Comments []APIComment `json:"comments"`
+	}
+	bob.expectJSON(http.StatusCreated, "POST", entry+"/comments", map[string]string{"comment": "hi"}, &comment)
+	if len(comment.Comments) != 1 {
+		t.Fatalf("got %d comments, want 1", len(comment.Comments))
+	}
+	commentPath := "/api/v1/comments/" + strconv.Itoa(comment.Comments[0].ID)
+	alice.expectJSON(http.StatusOK, "PUT", commentPath+"/hidden", map[string]bool{"hidden": true}, nil)
+	alice.expectJSON(http.StatusOK, "PUT", entry+"/comments_locked", map[string]bool{"locked": true}, nil)
+	bob.expectJSON(http.StatusForbidden, "POST", entry+"/comments", map[string]string{"comment": "again"}, nil)
+	bob.expectJSON(http.StatusNoContent, "DELETE", commentPath, nil, nil)
+	carol.expectJSON(http.StatusOK, "GET", entry, nil, nil)
+
+	alice.expectJSON(http.StatusOK, "GET", "/api/v1/dashboard", nil, nil)
+	alice.expectJSON(http.StatusOK, "GET", "/api/v1/footprints", nil, nil)
+	alice.expectJSON(http.StatusOK, "GET", "/api/v1/friends", nil, nil)
+
+	carol.expectJSON(http.StatusCreated, "POST", "/api/v1/friends/alice", nil, nil)
+	carol.expectJSON(http.StatusNoContent, "DELETE", "/api/v1/friend_requests/alice", nil, nil)
+	carol.expectJSON(http.StatusCreated, "POST", "/api/v1/friends/alice", nil, nil)
+	alice.expectJSON(http.StatusOK, "GET", "/api/v1/friend_requests", nil, nil)
+	alice.expectJSON(http.StatusNoContent, "POST", "/api/v1/friend_requests/carol/decline", nil, nil)
+	carol.expectJSON(http.StatusCreated, "POST", "/api/v1/friends/alice", nil, nil)
+	alice.expectJSON(http.StatusOK, "POST", "/api/v1/friend_requests/carol/accept", nil, nil)
+	alice.expectJSON(http.StatusNoContent, "DELETE", "/api/v1/friends/carol", nil, nil)
+
+	alice.expectJSON(http.StatusCreated, "POST", "/api/v1/blocks/carol", nil, nil)
+	alice.expectJSON(http.StatusOK, "GET", "/api/v1/blocks", nil, nil)
+	carol.expectJSON(http.StatusForbidden, "GET", entry, nil, nil)
+	alice.expectJSON(http.StatusNoContent, "DELETE", "/api/v1/blocks/carol", nil, nil)
+
+	alice.expectJSON(http.StatusNoContent, "DELETE", entry, nil, nil)
+	alice.expectJSON(http.StatusNotFound, "GET", entry, nil, nil)
+	alice.expectJSON(http.StatusNoContent, "POST", "/api/v1/logout", nil, nil)
+	alice.expectJSON(http.StatusUnauthorized, "GET", "/api/v1/dashboard", nil, nil)
+}
+
+func TestAdmin(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	s.loggedIn(s.alice)
+	c := s.client()
+
+	admin := func(status int, method, path string) string {
+		t.Helper()
+		req := c.request(method, path, "", nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		_, body := c.check(status, req)
+		return body
+	}
+	c.expect(http.StatusForbidden, "GET", "/admin/users/alice/sessions")
+
+	var sessions []SessionRecord
+	if err := json.Unmarshal([]byte(admin(http.StatusOK, "GET", "/admin/users/alice/sessions")), &sessions); err != nil || len(sessions) != 1 {
+		t.Fatalf("sessions of alice: %v %v", sessions, err)
+	}
+	admin(http.StatusNoContent, "DELETE", "/admin/sessions/"+sessions[0].Key)
+	admin(http.StatusNoContent, "DELETE", "/admin/users/alice/sessions")
+	admin(http.StatusOK, "GET", "/admin/friend_cache")
+	admin(http.StatusOK, "GET", "/initialize")
+	admin(http.StatusOK, "POST", "/initialize")
+	if body := admin(http.StatusOK, "GET", "/metrics"); !strings.Contains(body, `route="/admin/friend_cache"`) {
+		t.Errorf("metrics miss the admin requests:\n%s", body)
+	}
+	for _, p := range []string{"/", "/cmdline", "/profile?seconds=1", "/symbol", "/block", "/heap", "/goroutine", "/threadcreate"} {
+		admin(http.StatusOK, "GET", "/debug/pprof"+p)
+	}
+	c.expect(http.StatusNotFound, "GET", "/css/missing.css")
+}
+
+// TestInitialize changes the initial data through the site and checks that
+// /initialize puts it back.
+func TestInitialize(t *testing.T) {
+	s := newTestSite(t)
+	defer s.server.Close()
+	repos := s.store.Repos(nil)
+	id, err := repos.Entries.Create(s.alice.ID, "seed", "seed content", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := repos.Comments.Create(id, s.bob.ID, "seed comment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.store.MarkInitial()
+
+	alice := s.loggedIn(s.alice)
+	bob := s.loggedIn(s.bob)
+	path := "/diary/entry/" + strconv.Itoa(id)
+	alice.expectForm(http.StatusSeeOther, path, url.Values{"title": {"edited"}, "content": {"edited content"}})
+	alice.expectForm(http.StatusSeeOther, path+"/lock", nil)
+	alice.expectForm(http.StatusSeeOther, "/diary/comments/"+strconv.Itoa(commentID)+"/hide", nil)
+	alice.expectForm(http.StatusSeeOther, path+"/delete", nil)
+	bob.expectForm(http.StatusSeeOther, "/blocks/alice", nil)
+	alice.expectForm(http.StatusSeeOther, "/settings/account_name", url.Values{"account_name": {"ally"}})
+	c := s.client()
+	c.expect(http.StatusOK, "GET", "/signup")
+	c.expectForm(http.StatusOK, "/signup", url.Values{"account_name": {"dave"}, "nick_name": {"Dave"}, "email": {"dave@example.com"}, "password": {"dave's password"}})
+
+	req := c.request("POST", "/initialize", "", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	c.check(http.StatusOK, req)
+
+	entry, err := repos.Entries.Get(id)
+	if err != nil || entry.Title != "seed" || entry.Content != "seed content" {
+		t.Errorf("entry after /initialize: %+v, %v", entry, err)
+	}
+	if revisions, _ := repos.Entries.Revisions(id); len(revisions) != 0 {
+		t.Errorf("revisions after /initialize: %+v", revisions)
+	}
+	if locked, _ := repos.Entries.CommentsLocked(id); locked {
+		t.Error("comments are still locked after /initialize")
+	}
+	if comment, err := repos.Comments.Get(commentID); err != nil || comment.Hidden {
+		t.Errorf("comment after /initialize: %+v, %v", comment, err)
+	}
+	if u, err := repos.Users.ByID(s.alice.ID); err != nil || u.AccountName != "alice" {
+		t.Errorf("alice after /initialize: %+v, %v", u, err)
+	}
+	if _, err := repos.Accounts.RenamedTo("alice"); err != ErrContentNotFound {
+		t.Errorf("rename of alice is remembered after /initialize: %v", err)
+	}
+	if friends, _ := repos.Relations.FriendSet(s.alice.ID); len(friends) != 1 {
+		t.Errorf("friends of alice after /initialize: %v", friends)
+	}
+	if blocked, _ := repos.Blocks.Between(s.alice.ID, s.bob.ID); blocked {
+		t.Error("block is kept after /initialize")
+	}
+	if _, err := repos.Users.ByAccountName("dave"); err != ErrContentNotFound {
+		t.Errorf("signup is kept after /initialize: %v", err)
+	}
+	alice.expect(http.StatusFound, "GET", "/")
+	s.loggedIn(s.alice).expect(http.StatusOK, "GET", path)
+}
+
+// TestReposPerServer serves two stores side by side, which only works if
+// every handler reads the repositories of its own request.
+func TestReposPerServer(t *testing.T) {
+	one := newTestSite(t)
+	defer one.server.Close()
+	other := newTestSite(t)
+	defer other.server.Close()
+	other.addUser("zed", "Zed")
+
+	one.loggedIn(one.alice).expect(http.StatusNotFound, "GET", "/profile/zed")
+	other.loggedIn(other.alice).expect(http.StatusOK, "GET", "/profile/zed")
+}
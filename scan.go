@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Rows are always selected with one of the column lists below and read with
+// the matching scan function, never with SELECT *, so that adding a column
+// changes nothing and users.passhash is only read where a password is
+// checked.
+
+// rowScanner is either *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const userColumns = "id, account_name, nick_name, email"
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.AccountName, &u.NickName, &u.Email)
+	return u, err
+}
+
+const profileColumns = "user_id, first_name, last_name, sex, birthday, pref, updated_at"
+
+func scanProfile(row rowScanner) (Profile, error) {
+	var p Profile
+	err := row.Scan(&p.UserID, &p.FirstName, &p.LastName, &p.Sex, &p.Birthday, &p.Pref, &p.UpdatedAt)
+	return p, err
+}
+
+// entryColumns lists the entries columns in the order scanEntry reads them.
+// Rows not yet backfilled have no title, and their body is read instead of
+// the content (see -backfill-entries). entryColumnsE is the same for
+// entries joined as e.
+const (
+	entryColumns  = "id, user_id, private, title, IF(title IS NULL, body, content), created_at"
+	entryColumnsE = "e.id, e.user_id, e.private, e.title, IF(e.title IS NULL, e.body, e.content), e.created_at"
+)
+
+func scanEntry(row rowScanner) (Entry, error) {
+	var e Entry
+	var private int
+	var title sql.NullString
+	var content string
+	if err := row.Scan(&e.ID, &e.UserID, &private, &title, &content, &e.CreatedAt); err != nil {
+		return Entry{}, err
+	}
+	e.Private = private == 1
+	if title.Valid {
+		e.Title, e.Content = title.String, content
+	} else {
+		e.Title, e.Content = splitEntryBody(content)
+	}
+	return e, nil
+}
+
+// commentColumnsC is commentColumns for comments joined as c.
+const (
+	commentColumns  = "id, entry_id, user_id, comment, created_at, hidden"
+	commentColumnsC = "c.id, c.entry_id, c.user_id, c.comment, c.created_at, c.hidden"
+)
+
+func scanComment(row rowScanner) (Comment, error) {
+	var c Comment
+	err := row.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt, &c.Hidden)
+	return c, err
+}
+
+// expectedColumns are the columns of the original tables the queries rely
+// on, by table.
+var expectedColumns = map[string][]string{
+	"users":      {"id", "account_name", "nick_name", "email", "passhash"},
+	"salts":      {"user_id", "salt"},
+	"profiles":   {"user_id", "first_name", "last_name", "sex", "birthday", "pref", "updated_at"},
+	"entries":    {"id", "user_id", "private", "body", "title", "content", "created_at", "deleted_at", "comments_locked"},
+	"comments":   {"id", "entry_id", "user_id", "comment", "created_at", "hidden", "deleted_at"},
+	"relations":  {"id", "one", "another", "created_at"},
+	"footprints": {"id", "user_id", "owner_id", "created_at"},
+}
+
+// checkColumns looks up expectedColumns in information_schema, so that a
+// schema the queries do not fit stops the app at startup rather than
+// failing requests.
+func checkColumns(q *DB) error {
+	rows, err := q.Query(`SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = DATABASE()`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	found := make(map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return err
+		}
+		found[table+"."+column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	missing := make([]string, 0)
+	for table, columns := range expectedColumns {
+		for _, column := range columns {
+			if !found[table+"."+column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing columns %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
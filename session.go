@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const sessionName = "isucon5q-go.session"
+
+// SessionRecord is the server-side state of one session. Key is the SHA-256
+// of the token stored in the cookie, so neither the table nor the admin API
+// ever exposes a usable session token.
+type SessionRecord struct {
+	Key        string    `json:"key"`
+	UserID     int       `json:"user_id"`
+	Data       []byte    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	RemoteAddr string    `json:"remote_addr"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// SessionBackend persists session records.
+type SessionBackend interface {
+	// Get returns nil without error when no record exists for key.
+	Get(key string) (*SessionRecord, error)
+	// Put creates or updates a record. CreatedAt of an existing record is kept.
+	Put(rec *SessionRecord) error
+	Touch(key string, t time.Time) error
+	Delete(key string) error
+	DeleteByUser(userID int) error
+	ListByUser(userID int) ([]SessionRecord, error)
+	// DeleteExpired deletes records last seen before idleBefore, records
+	// without a user last seen before anonymousBefore, and records created
+	// before createdBefore.
+	DeleteExpired(idleBefore, anonymousBefore, createdBefore time.Time) error
+	// DeleteAll deletes every record, for /initialize.
+	DeleteAll() error
+}
+
+// ServerStore is a sessions.Store which keeps only a random token in the
+// cookie and everything else in a SessionBackend, so sessions can be revoked.
+type ServerStore struct {
+	Backend     SessionBackend
+	IdleTimeout time.Duration
+	MaxAge      time.Duration
+	// AnonymousTimeout is the idle timeout of sessions without a user, which
+	// only hold the CSRF token of a login or signup form.
+	AnonymousTimeout time.Duration
+}
+
+func NewServerStore(backend SessionBackend, idle, maxAge time.Duration) *ServerStore {
+	return &ServerStore{Backend: backend, IdleTimeout: idle, MaxAge: maxAge, AnonymousTimeout: time.Hour}
+}
+
+func (s *ServerStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *ServerStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	session.Options = s.options()
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	key := sessionKey(c.Value)
+	rec, err := s.Backend.Get(key)
+	if err != nil || rec == nil {
+		return session, err
+	}
+	now := time.Now()
+	if s.expired(rec, now) {
+		return session, s.Backend.Delete(key)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(rec.Data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = c.Value
+	session.IsNew = false
+	// Touching on every request would turn each page view into a write.
+	if now.Sub(rec.LastSeenAt) > time.Minute {
+		err = s.Backend.Touch(key, now)
+	}
+	return session, err
+}
+
+func (s *ServerStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options != nil && session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.Backend.Delete(sessionKey(session.ID)); err != nil {
+				return err
+			}
+		}
+		opts := s.options()
+		opts.MaxAge = -1
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", opts))
+		return nil
+	}
+	if session.ID == "" {
+		token, err := newSessionToken()
+		if err != nil {
+			return err
+		}
+		session.ID = token
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(session.Values); err != nil {
+		return err
+	}
+	userID, _ := session.Values["user_id"].(int)
+	now := time.Now()
+	rec := &SessionRecord{
+		Key:        sessionKey(session.ID),
+		UserID:     userID,
+		Data:       buf.Bytes(),
+		UserAgent:  truncate(r.UserAgent(), 255),
+		RemoteAddr: truncate(r.RemoteAddr, 64),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	if err := s.Backend.Put(rec); err != nil {
+		return err
+	}
+	opts := s.options()
+	if userID == 0 {
+		opts.MaxAge = int(s.anonymousTimeout() / time.Second)
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, opts))
+	return nil
+}
+
+// Renew discards the stored record and makes the next Save issue a new
+// token, keeping the values. Called on login against session fixation.
+func (s *ServerStore) Renew(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	err := s.Backend.Delete(sessionKey(session.ID))
+	session.ID = ""
+	return err
+}
+
+// GC removes expired records every interval until the process exits.
+func (s *ServerStore) GC(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		s.Backend.DeleteExpired(now.Add(-s.IdleTimeout), now.Add(-s.anonymousTimeout()), now.Add(-s.MaxAge))
+	}
+}
+
+func (s *ServerStore) expired(rec *SessionRecord, now time.Time) bool {
+	idle := now.Sub(rec.LastSeenAt)
+	return idle > s.IdleTimeout || rec.UserID == 0 && idle > s.anonymousTimeout() || now.Sub(rec.CreatedAt) > s.MaxAge
+}
+
+// anonymousTimeout is never longer than IdleTimeout.
+func (s *ServerStore) anonymousTimeout() time.Duration {
+	if s.AnonymousTimeout > 0 && s.AnonymousTimeout < s.IdleTimeout {
+		return s.AnonymousTimeout
+	}
+	return s.IdleTimeout
+}
+
+func (s *ServerStore) options() *sessions.Options {
+	return &sessions.Options{Path: "/", MaxAge: int(s.MaxAge / time.Second), HttpOnly: true, SameSite: http.SameSiteLaxMode}
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// MySQLSessionBackend stores sessions in the sessions table, which migration
+// 2 in migrate.go creates.
+type MySQLSessionBackend struct {
+	DB *sql.DB
+}
+
+func (b *MySQLSessionBackend) Get(key string) (*SessionRecord, error) {
+	row := b.DB.QueryRow(`SELECT id, user_id, data, user_agent, remote_addr, created_at, last_seen_at FROM sessions WHERE id = ?`, key)
+	rec := SessionRecord{}
+	err := row.Scan(&rec.Key, &rec.UserID, &rec.Data, &rec.UserAgent, &rec.RemoteAddr, &rec.CreatedAt, &rec.LastSeenAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (b *MySQLSessionBackend) Put(rec *SessionRecord) error {
+	_, err := b.DB.Exec(`INSERT INTO sessions (id, user_id, data, user_agent, remote_addr, created_at, last_seen_at)
+VALUES (?,?,?,?,?,?,?)
+ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), data = VALUES(data), user_agent = VALUES(user_agent), remote_addr = VALUES(remote_addr), last_seen_at = VALUES(last_seen_at)`,
+		rec.Key, rec.UserID, rec.Data, rec.UserAgent, rec.RemoteAddr, rec.CreatedAt, rec.LastSeenAt)
+	return err
+}
+
+func (b *MySQLSessionBackend) Touch(key string, t time.Time) error {
+	_, err := b.DB.Exec(`UPDATE sessions SET last_seen_at = ? WHERE id = ?`, t, key)
+	return err
+}
+
+func (b *MySQLSessionBackend) Delete(key string) error {
+	_, err := b.DB.Exec(`DELETE FROM sessions WHERE id = ?`, key)
+	return err
+}
+
+func (b *MySQLSessionBackend) DeleteByUser(userID int) error {
+	_, err := b.DB.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+func (b *MySQLSessionBackend) ListByUser(userID int) ([]SessionRecord, error) {
+	rows, err := b.DB.Query(`SELECT id, user_id, user_agent, remote_addr, created_at, last_seen_at FROM sessions WHERE user_id = ? ORDER BY last_seen_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recs := make([]SessionRecord, 0, 4)
+	for rows.Next() {
+		rec := SessionRecord{}
+		if err := rows.Scan(&rec.Key, &rec.UserID, &rec.UserAgent, &rec.RemoteAddr, &rec.CreatedAt, &rec.LastSeenAt); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+func (b *MySQLSessionBackend) DeleteExpired(idleBefore, anonymousBefore, createdBefore time.Time) error {
+	_, err := b.DB.Exec(`DELETE FROM sessions WHERE last_seen_at < ? OR (user_id = 0 AND last_seen_at < ?) OR created_at < ?`, idleBefore, anonymousBefore, createdBefore)
+	return err
+}
+
+func (b *MySQLSessionBackend) DeleteAll() error {
+	_, err := b.DB.Exec(`DELETE FROM sessions`)
+	return err
+}
+
+// MemorySessionBackend keeps sessions in process memory. It is meant for
+// tests and local development; sessions are lost on restart.
+type MemorySessionBackend struct {
+	mu   sync.Mutex
+	recs map[string]SessionRecord
+}
+
+func NewMemorySessionBackend() *MemorySessionBackend {
+	return &MemorySessionBackend{recs: make(map[string]SessionRecord)}
+}
+
+func (b *MemorySessionBackend) Get(key string) (*SessionRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rec, ok := b.recs[key]
+	if !ok {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+func (b *MemorySessionBackend) Put(rec *SessionRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := *rec
+	if old, ok := b.recs[r.Key]; ok {
+		r.CreatedAt = old.CreatedAt
+	}
+	b.recs[r.Key] = r
+	return nil
+}
+
+func (b *MemorySessionBackend) Touch(key string, t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rec, ok := b.recs[key]; ok {
+		rec.LastSeenAt = t
+		b.recs[key] = rec
+	}
+	return nil
+}
+
+func (b *MemorySessionBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.recs, key)
+	return nil
+}
+
+func (b *MemorySessionBackend) DeleteByUser(userID int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, rec := range b.recs {
+		if rec.UserID == userID {
+			delete(b.recs, key)
+		}
+	}
+	return nil
+}
+
+func (b *MemorySessionBackend) ListByUser(userID int) ([]SessionRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recs := make([]SessionRecord, 0, 4)
+	for _, rec := range b.recs {
+		if rec.UserID == userID {
+			rec.Data = nil
+			recs = append(recs, rec)
+		}
+	}
+	sort.Sort(byLastSeen(recs))
+	return recs, nil
+}
+
+func (b *MemorySessionBackend) DeleteExpired(idleBefore, anonymousBefore, createdBefore time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, rec := range b.recs {
+		if rec.LastSeenAt.Before(idleBefore) || rec.UserID == 0 && rec.LastSeenAt.Before(anonymousBefore) || rec.CreatedAt.Before(createdBefore) {
+			delete(b.recs, key)
+		}
+	}
+	return nil
+}
+
+func (b *MemorySessionBackend) DeleteAll() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recs = make(map[string]SessionRecord)
+	return nil
+}
+
+type byLastSeen []SessionRecord
+
+func (s byLastSeen) Len() int           { return len(s) }
+func (s byLastSeen) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastSeen) Less(i, j int) bool { return s[i].LastSeenAt.After(s[j].LastSeenAt) }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const tokenChangeEmail = "change_email"
+
+// settingsNotices are shown on /settings after a change, keyed by the
+// "updated" query parameter.
+var settingsNotices = map[string]string{
+	"nick_name":    "ニックネームを変更しました",
+	"account_name": "アカウント名を変更しました",
+	"email":        "新しいメールアドレスに確認メールを送信しました。メールのURLを開くと変更されます",
+	"password":     "パスワードを変更しました。他の端末はログアウトされました",
+}
+
+func renderSettings(w http.ResponseWriter, r *http.Request, status int, msg string) error {
+	return render(w, r, status, "settings.html", struct {
+		User    User
+		Notice  string
+		Message string
+	}{*currentUser(r), settingsNotices[r.FormValue("updated")], msg})
+}
+
+// settingsFailed shows errors meant for the user next to the forms.
+func settingsFailed(w http.ResponseWriter, r *http.Request, err error) error {
+	if e, ok := err.(*AppError); ok && e.Cause == nil {
+		return renderSettings(w, r, e.Status, e.Message)
+	}
+	return err
+}
+
+// reauthenticate checks the current password before the email or password
+// is changed. Failures count against the login limiter.
+func reauthenticate(w http.ResponseWriter, r *http.Request, passwd string) error {
+	user := currentUser(r)
+	ip := remoteIP(r)
+	if wait := loginLimiter.Wait(user.Email, ip); wait > 0 {
+		retryAfter(w, wait)
+		return ErrTooManyLogins
+	}
+	passhash, salt, err := reposFor(r).Accounts.CredentialsByID(user.ID)
+	if err != nil {
+		return err
+	}
+	if !hasherFor(passhash).Verify(passwd, salt, passhash) {
+		if err := loginFailed(r, user.ID, user.Email); err != ErrAuthentication {
+			return err
+		}
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+func settingsUpdated(w http.ResponseWriter, r *http.Request, field string) error {
+	http.Redirect(w, r, "/settings?updated="+field, http.StatusSeeOther)
+	return nil
+}
+
+func GetSettings(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+	return renderSettings(w, r, http.StatusOK, "")
+}
+
+func PostSettingsNickName(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+	nick := strings.TrimSpace(r.FormValue("nick_name"))
+	if nick == "" || utf8.RuneCountInString(nick) > 64 {
+		return renderSettings(w, r, http.StatusBadRequest, "ニックネームは1〜64文字で入力してください")
+	}
+	if err := reposFor(r).Accounts.SetNickName(currentUser(r).ID, nick); err != nil {
+		return err
+	}
+	return settingsUpdated(w, r, "nick_name")
+}
+
+func PostSettingsAccountName(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+	name := r.FormValue("account_name")
+	if !accountNamePattern.MatchString(name) {
+		return renderSettings(w, r, http.StatusBadRequest, "アカウント名は3〜32文字の英数字と_で入力してください")
+	}
+	user := currentUser(r)
+	if name == user.AccountName {
+		return settingsUpdated(w, r, "account_name")
+	}
+	if err := renameAccount(r, user, name); err != nil {
+		return settingsFailed(w, r, err)
+	}
+	return settingsUpdated(w, r, "account_name")
+}
+
+// renameAccount changes the account name and remembers the old one, so that
+// old URLs redirect until someone else takes the name.
+func renameAccount(r *http.Request, user *User, name string) error {
+	accounts := reposFor(r).Accounts
+	if err := accounts.Taken(name, ""); err != nil {
+		return err
+	}
+	return accounts.Rename(user, name)
+}
+
+// redirectRenamed sends requests for a renamed account to prefix plus its
+// current name. It reports false if account was never renamed. The redirect
+// is temporary, since the old name may be taken by someone else later.
+func redirectRenamed(w http.ResponseWriter, r *http.Request, prefix, account string) (bool, error) {
+	name, err := reposFor(r).Accounts.RenamedTo(account)
+	if err == ErrContentNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	target := prefix + name
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+	return true, nil
+}
+
+// PostSettingsEmail mails a confirmation to the new address; the address is
+// only changed once its link is opened.
+func PostSettingsEmail(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+	email := strings.TrimSpace(r.FormValue("email"))
+	if !validEmail(email) {
+		return renderSettings(w, r, http.StatusBadRequest, "メールアドレスが正しくありません")
+	}
+	if err := reauthenticate(w, r, r.FormValue("password")); err != nil {
+		return settingsFailed(w, r, err)
+	}
+	repos := reposFor(r)
+	if err := repos.Accounts.Taken("", email); err != nil {
+		return settingsFailed(w, r, err)
+	}
+	token, err := repos.Tokens.Issue(currentUser(r).ID, tokenChangeEmail, email, verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+	err = mailer.Send(Mail{
+		To:      email,
+		Subject: "ISUxi メールアドレスの変更",
+		Body:    "以下のURLを開くと、ISUxiのメールアドレスがこのアドレスに変更されます。\n\n" + baseURL + "/settings/email/confirm?token=" + token + "\n\nこのURLは24時間有効です。\n",
+	})
+	if err != nil {
+		return err
+	}
+	return settingsUpdated(w, r, "email")
+}
+
+func GetSettingsEmailConfirm(w http.ResponseWriter, r *http.Request) error {
+	repos := reposFor(r)
+	userID, email, err := repos.Tokens.Consume(r.FormValue("token"), tokenChangeEmail)
+	if err != nil {
+		return err
+	}
+	if err := repos.Accounts.Taken("", email); err != nil {
+		return err
+	}
+	if err := repos.Accounts.SetEmail(userID, email); err != nil {
+		return err
+	}
+	return message(w, r, http.StatusOK, "メールアドレスを変更しました", "次回から "+email+" でログインしてください。")
+}
+
+// PostSettingsPassword logs out every other session of the user; the current
+// one is kept under a new session ID.
+func PostSettingsPassword(w http.ResponseWriter, r *http.Request) error {
+	if ok, err := authenticated(w, r); !ok {
+		return err
+	}
+	passwd := r.FormValue("new_password")
+	if msg := validPassword(passwd); msg != "" {
+		return renderSettings(w, r, http.StatusBadRequest, msg)
+	}
+	if err := reauthenticate(w, r, r.FormValue("password")); err != nil {
+		return settingsFailed(w, r, err)
+	}
+	user := currentUser(r)
+	if err := setPassword(reposFor(r).Accounts, user.ID, passwd); err != nil {
+		return err
+	}
+	if err := store.Backend.DeleteByUser(user.ID); err != nil {
+		return err
+	}
+	session := getSession(w, r)
+	if err := store.Renew(session); err != nil {
+		return err
+	}
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
+	return settingsUpdated(w, r, "password")
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Purposes of user_tokens. A token is mailed to its email and can be used
+// once before it expires.
+const (
+	tokenVerifyEmail   = "verify_email"
+	tokenResetPassword = "reset_password"
+)
+
+const (
+	verifyTokenTTL = 24 * time.Hour
+	resetTokenTTL  = time.Hour
+)
+
+var accountNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]{3,32}$`)
+
+type SignupForm struct {
+	AccountName string
+	NickName    string
+	Email       string
+	Password    string
+}
+
+// validate returns the message for the first invalid field, or "".
+func (f SignupForm) validate() string {
+	switch {
+	case !accountNamePattern.MatchString(f.AccountName):
+		return "アカウント名は3〜32文字の英数字と_で入力してください"
+	case f.NickName == "" || utf8.RuneCountInString(f.NickName) > 64:
+		return "ニックネームは1〜64文字で入力してください"
+	case !validEmail(f.Email):
+		return "メールアドレスが正しくありません"
+	}
+	return validPassword(f.Password)
+}
+
+func validEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s && len(s) <= 255
+}
+
+// maxPasswordBytes is where bcrypt stops reading a password; longer ones
+// are refused rather than silently cut.
+const maxPasswordBytes = 72
+
+func validPassword(s string) string {
+	switch {
+	case len(s) < 8:
+		return "パスワードは8文字以上で入力してください"
+	case len(s) > maxPasswordBytes:
+		return "パスワードは72バイト (半角72文字) 以内で入力してください"
+	}
+	return ""
+}
+
+func isDuplicateKey(err error) bool {
+	_, ok := duplicateKey(err)
+	return ok
+}
+
+// duplicateKey returns the name of the unique key a duplicate entry error
+// is about, such as "email", and false for any other error. MySQL 8 puts
+// the table before the name, as in "users.email".
+func duplicateKey(err error) (string, bool) {
+	e, ok := err.(*mysql.MySQLError)
+	if !ok || e.Number != 1062 {
+		return "", false
+	}
+	const marker = "for key '"
+	i := strings.LastIndex(e.Message, marker)
+	if i < 0 {
+		return "", true
+	}
+	key := strings.TrimSuffix(e.Message[i+len(marker):], "'")
+	return key[strings.LastIndex(key, ".")+1:], true
+}
+
+// limitMails refuses a request to mail the address while mailLimiter is
+// backing off, and counts the request against both the address and the
+// client.
+func limitMails(w http.ResponseWriter, r *http.Request, email string) error {
+	ip := remoteIP(r)
+	if wait := mailLimiter.Wait(email, ip); wait > 0 {
+		retryAfter(w, wait)
+		return ErrTooManyMails
+	}
+	mailLimiter.Fail(email, ip)
+	return nil
+}
+
+// createUser adds the user with a new salt and a pending email
+// verification.
+func createUser(r *http.Request, f SignupForm) (int, error) {
+	accounts := reposFor(r).Accounts
+	if err := accounts.Taken(f.AccountName, f.Email); err != nil {
+		return 0, err
+	}
+	salt, err := newSessionToken()
+	if err != nil {
+		return 0, err
+	}
+	salt = salt[:20]
+	passhash, err := passwordHasher.Hash(f.Password, salt)
+	if err != nil {
+		return 0, err
+	}
+	return accounts.Create(f, salt, passhash)
+}
+
+func sendVerification(tokens TokenRepo, userID int, email string) error {
+	token, err := tokens.Issue(userID, tokenVerifyEmail, email, verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(Mail{
+		To:      email,
+		Subject: "ISUxi メールアドレスの確認",
+		Body:    "以下のURLを開いてメールアドレスを確認してください。\n\n" + baseURL + "/verify?token=" + token + "\n\nこのURLは24時間有効です。\n",
+	})
+}
+
+func sendPasswordReset(tokens TokenRepo, userID int, email string) error {
+	token, err := tokens.Issue(userID, tokenResetPassword, email, resetTokenTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(Mail{
+		To:      email,
+		Subject: "ISUxi パスワードの再設定",
+		Body:    "以下のURLを開いて新しいパスワードを設定してください。\n\n" + baseURL + "/password/reset?token=" + token + "\n\nこのURLは1時間有効です。心当たりがない場合はこのメールを無視してください。\n",
+	})
+}
+
+// message renders a page with just a title and a message.
+func message(w http.ResponseWriter, r *http.Request, status int, title, msg string) error {
+	return render(w, r, status, "message.html", struct {
+		Title   string
+		Message string
+	}{title, msg})
+}
+
+func renderSignup(w http.ResponseWriter, r *http.Request, status int, form SignupForm, msg string) error {
+	return render(w, r, status, "signup.html", struct {
+		Form    SignupForm
+		Message string
+	}{form, msg})
+}
+
+func GetSignup(w http.ResponseWriter, r *http.Request) error {
+	return renderSignup(w, r, http.StatusOK, SignupForm{}, "")
+}
+
+func PostSignup(w http.ResponseWriter, r *http.Request) error {
+	form := SignupForm{
+		AccountName: r.FormValue("account_name"),
+		NickName:    strings.TrimSpace(r.FormValue("nick_name")),
+		Email:       strings.TrimSpace(r.FormValue("email")),
+		Password:    r.FormValue("password"),
+	}
+	if msg := form.validate(); msg != "" {
+		return renderSignup(w, r, http.StatusBadRequest, form, msg)
+	}
+	userID, err := createUser(r, form)
+	if err == ErrAccountNameTaken || err == ErrEmailTaken {
+		e := err.(*AppError)
+		return renderSignup(w, r, e.Status, form, e.Message)
+	}
+	if err != nil {
+		return err
+	}
+	if err := sendVerification(reposFor(r).Tokens, userID, form.Email); err != nil {
+		return err
+	}
+	return message(w, r, http.StatusOK, "登録しました", form.Email+" に確認メールを送信しました。メールのURLを開くとログインできるようになります。")
+}
+
+func GetVerify(w http.ResponseWriter, r *http.Request) error {
+	repos := reposFor(r)
+	userID, email, err := repos.Tokens.Consume(r.FormValue("token"), tokenVerifyEmail)
+	if err != nil {
+		return err
+	}
+	if err := repos.Accounts.VerifyEmail(userID, email); err != nil {
+		return err
+	}
+	return message(w, r, http.StatusOK, "メールアドレスを確認しました", "ログインしてください。")
+}
+
+// PostVerifyResend mails a new verification link. The answer is the same
+// whether or not the address is pending, so that it reveals nothing.
+func PostVerifyResend(w http.ResponseWriter, r *http.Request) error {
+	email := strings.TrimSpace(r.FormValue("email"))
+	if err := limitMails(w, r, email); err != nil {
+		return err
+	}
+	repos := reposFor(r)
+	userID, err := repos.Accounts.PendingVerification(email)
+	if err != nil && err != ErrContentNotFound {
+		return err
+	}
+	if err == nil {
+		if err := sendVerification(repos.Tokens, userID, email); err != nil {
+			return err
+		}
+	}
+	return message(w, r, http.StatusOK, "確認メールを送信しました", "登録済みで未確認のメールアドレスであれば、確認メールが届きます。")
+}
+
+func GetPasswordForgot(w http.ResponseWriter, r *http.Request) error {
+	return render(w, r, http.StatusOK, "password_forgot.html", struct{ Message string }{""})
+}
+
+// PostPasswordForgot answers the same for unknown addresses, so that it
+// reveals nothing about who is registered.
+func PostPasswordForgot(w http.ResponseWriter, r *http.Request) error {
+	email := strings.TrimSpace(r.FormValue("email"))
+	if err := limitMails(w, r, email); err != nil {
+		return err
+	}
+	repos := reposFor(r)
+	user, err := repos.Users.ByEmail(email)
+	if err != nil && err != ErrContentNotFound {
+		return err
+	}
+	if err == nil {
+		if err := sendPasswordReset(repos.Tokens, user.ID, email); err != nil {
+			return err
+		}
+	}
+	return message(w, r, http.StatusOK, "メールを送信しました", "登録済みのメールアドレスであれば、パスワードを再設定するURLが届きます。")
+}
+
+func renderPasswordReset(w http.ResponseWriter, r *http.Request, status int, token, msg string) error {
+	return render(w, r, status, "password_reset.html", struct {
+		Token   string
+		Message string
+	}{token, msg})
+}
+
+func GetPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	return renderPasswordReset(w, r, http.StatusOK, r.FormValue("token"), "")
+}
+
+// PostPasswordReset sets the new password and logs the user out everywhere.
+// Opening the mail also proves the address, so a pending verification of
+// it is completed.
+func PostPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	token := r.FormValue("token")
+	passwd := r.FormValue("password")
+	if msg := validPassword(passwd); msg != "" {
+		return renderPasswordReset(w, r, http.StatusBadRequest, token, msg)
+	}
+	repos := reposFor(r)
+	userID, email, err := repos.Tokens.Consume(token, tokenResetPassword)
+	if err != nil {
+		return err
+	}
+	if err := setPassword(repos.Accounts, userID, passwd); err != nil {
+		return err
+	}
+	if err := repos.Accounts.VerifyEmail(userID, email); err != nil {
+		return err
+	}
+	if err := store.Backend.DeleteByUser(userID); err != nil {
+		return err
+	}
+	// Proving access to the address ends the lockout.
+	if err := repos.Logins.ResetLockout(email); err != nil {
+		return err
+	}
+	loginLimiter.Succeed(email)
+	return message(w, r, http.StatusOK, "パスワードを変更しました", "新しいパスワードでログインしてください。")
+}
+
+// setPassword hashes passwd with the configured scheme and the user's salt.
+func setPassword(accounts AccountRepo, userID int, passwd string) error {
+	_, salt, err := accounts.CredentialsByID(userID)
+	if err != nil {
+		return err
+	}
+	passhash, err := passwordHasher.Hash(passwd, salt)
+	if err != nil {
+		return err
+	}
+	return accounts.SetPasshash(userID, passhash)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDuplicateKey(t *testing.T) {
+	for _, c := range []struct {
+		err error
+		key string
+		ok  bool
+	}{
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a@example.com' for key 'email'"}, "email", true},
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'email' for key 'users.account_name'"}, "account_name", true},
+		{&mysql.MySQLError{Number: 1452, Message: "Cannot add or update a child row"}, "", false},
+		{errors.New("Duplicate entry 'x' for key 'email'"), "", false},
+	} {
+		if key, ok := duplicateKey(c.err); key != c.key || ok != c.ok {
+			t.Errorf("duplicateKey(%v) = %q, %v; want %q, %v", c.err, key, ok, c.key, c.ok)
+		}
+	}
+}
+
+func TestValidPassword(t *testing.T) {
+	for _, c := range []struct {
+		passwd string
+		ok     bool
+	}{
+		{"short", false},
+		{"long enough", true},
+		{strings.Repeat("a", maxPasswordBytes), true},
+		{strings.Repeat("a", maxPasswordBytes+1), false},
+		// 25 characters, but 75 bytes.
+		{strings.Repeat("あ", 25), false},
+	} {
+		if msg := validPassword(c.passwd); (msg == "") != c.ok {
+			t.Errorf("validPassword(%d bytes) = %q", len(c.passwd), msg)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// DB wraps *sql.DB to time every query and log it under the ID of the
+// request it ran for. The DB that main opens is not bound to a request;
+// MySQLRepos binds a copy of it to each request.
+type DB struct {
+	*sql.DB
+	RequestID string
+	Queries   *QueryStats
+}
+
+// QueryStats counts the queries of one request.
+type QueryStats struct {
+	count int64
+	nanos int64
+}
+
+func (s *QueryStats) add(d time.Duration) {
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.nanos, int64(d))
+}
+
+func (s *QueryStats) Count() int64 {
+	return atomic.LoadInt64(&s.count)
+}
+
+func (s *QueryStats) Duration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.nanos))
+}
+
+// SQL logging, from ISUCON5_SQL_LOG: "off", "slow" (the default) or "all".
+// "slow" only logs queries which take at least sqlSlowThreshold.
+var (
+	sqlLogMode       = "slow"
+	sqlSlowThreshold = 100 * time.Millisecond
+)
+
+func NewDB(conn *sql.DB) *DB {
+	return &DB{conn, "-", &QueryStats{}}
+}
+
+func (q *DB) logQuery(query string, start time.Time, err error) {
+	d := time.Since(start)
+	q.Queries.add(d)
+	if sqlLogMode == "off" || (sqlLogMode == "slow" && d < sqlSlowThreshold) {
+		return
+	}
+	kv := []interface{}{"request_id", q.RequestID, "duration_ms", millis(d), "query", query}
+	if err != nil && err != sql.ErrNoRows {
+		kv = append(kv, "error", err.Error())
+	}
+	logEvent("sql", kv...)
+}
+
+func (q *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := q.DB.Query(query, args...)
+	q.logQuery(query, start, err)
+	return rows, err
+}
+
+// QueryRow is timed up to the query itself; scanning the row is not.
+func (q *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := q.DB.QueryRow(query, args...)
+	q.logQuery(query, start, nil)
+	return row
+}
+
+func (q *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := q.DB.Exec(query, args...)
+	q.logQuery(query, start, err)
+	return res, err
+}
+
+func (q *DB) Begin() (*Tx, error) {
+	tx, err := q.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx, q}, nil
+}
+
+// Tx is a transaction whose queries are logged like those of its DB.
+type Tx struct {
+	*sql.Tx
+	db *DB
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := tx.Tx.Query(query, args...)
+	tx.db.logQuery(query, start, err)
+	return rows, err
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := tx.Tx.QueryRow(query, args...)
+	tx.db.logQuery(query, start, nil)
+	return row
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := tx.Tx.Exec(query, args...)
+	tx.db.logQuery(query, start, err)
+	return res, err
+}
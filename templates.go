@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// templatePartials are parsed into every page.
+var templatePartials = []string{"header.html", "pager.html"}
+
+// templateFuncs are the functions of every page. Nothing here may depend on
+// the request; see pageView.
+var templateFuncs = template.FuncMap{
+	"prefectures": func() []string {
+		return prefs
+	},
+	"sexes": func() []string {
+		return sexes
+	},
+	"substring": func(s string, l int) string {
+		if len(s) > l {
+			return s[:l]
+		}
+		return s
+	},
+	"split": strings.Split,
+}
+
+// pageView is what every page is executed with: the data of the handler as
+// .Data, and methods for what a page looks up about the request while it is
+// rendered. Pages wrap their body in {{ with .Data }}, so that the methods
+// are called on $, as in {{ $.User .UserID }} or {{ $.CSRFField }}.
+type pageView struct {
+	Data interface{}
+
+	w http.ResponseWriter
+	r *http.Request
+}
+
+func (v *pageView) User(id int) (*User, error) {
+	return loaderFor(v.r).User(id)
+}
+
+func (v *pageView) CurrentUser() (*User, error) {
+	return getCurrentUser(v.w, v.r)
+}
+
+func (v *pageView) IsFriend(id int) (bool, error) {
+	return isFriend(v.w, v.r, id)
+}
+
+func (v *pageView) Entry(id int) (Entry, error) {
+	return loaderFor(v.r).Entry(id)
+}
+
+func (v *pageView) CSRFField() (template.HTML, error) {
+	return csrfField(v.w, v.r)
+}
+
+func (v *pageView) NumComments(id int) (int, error) {
+	return reposFor(v.r).Comments.Count(id)
+}
+
+// TemplateRegistry holds every page under Dir, parsed once together with
+// the partials. The same page serves every request; what differs between
+// requests comes in through pageView.
+type TemplateRegistry struct {
+	Dir string
+
+	mu      sync.RWMutex
+	pages   map[string]*template.Template
+	version string
+}
+
+var templates *TemplateRegistry
+
+// NewTemplateRegistry parses all templates and fails on the first error.
+func NewTemplateRegistry(dir string) (*TemplateRegistry, error) {
+	reg := &TemplateRegistry{Dir: dir}
+	if err := reg.Load(); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// Load parses the templates again and replaces the current set only if all
+// of them parse.
+func (reg *TemplateRegistry) Load() error {
+	version, err := reg.scan()
+	if err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(reg.Dir, "*.html"))
+	if err != nil {
+		return err
+	}
+	partials := make([]string, 0, len(templatePartials))
+	for _, p := range templatePartials {
+		partials = append(partials, filepath.Join(reg.Dir, p))
+	}
+	pages := make(map[string]*template.Template, len(files))
+	for _, f := range files {
+		name := filepath.Base(f)
+		if isPartial(name) {
+			continue
+		}
+		tpl, err := template.New(name).Funcs(templateFuncs).ParseFiles(append([]string{f}, partials...)...)
+		if err != nil {
+			return err
+		}
+		pages[name] = tpl
+	}
+	reg.mu.Lock()
+	reg.pages = pages
+	reg.version = version
+	reg.mu.Unlock()
+	return nil
+}
+
+// Page returns the parsed page.
+func (reg *TemplateRegistry) Page(file string) (*template.Template, error) {
+	reg.mu.RLock()
+	tpl, ok := reg.pages[file]
+	reg.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown template: " + file)
+	}
+	return tpl, nil
+}
+
+// Watch reloads the templates whenever a file under Dir changes. A template
+// that fails to parse is logged and the previous set stays in use.
+func (reg *TemplateRegistry) Watch(interval time.Duration) {
+	reg.mu.RLock()
+	last := reg.version
+	reg.mu.RUnlock()
+	for range time.Tick(interval) {
+		version, err := reg.scan()
+		if err != nil {
+			log.Printf("Failed to watch templates: %s", err.Error())
+			continue
+		}
+		if version == last {
+			continue
+		}
+		last = version
+		if err := reg.Load(); err != nil {
+			log.Printf("Failed to reload templates: %s", err.Error())
+			continue
+		}
+		log.Printf("Reloaded templates.")
+	}
+}
+
+// scan summarizes names, sizes and modification times of the files in Dir.
+func (reg *TemplateRegistry) scan() (string, error) {
+	infos, err := ioutil.ReadDir(reg.Dir)
+	if err != nil {
+		return "", err
+	}
+	var version string
+	for _, fi := range infos {
+		version += fi.Name() + " " + fi.ModTime().String() + " " + strconv.FormatInt(fi.Size(), 10) + "\n"
+	}
+	return version, nil
+}
+
+func isPartial(name string) bool {
+	for _, p := range templatePartials {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+)
+
+// The index page shows recent entries and comments of friends. Instead of
+// scanning the newest rows of entries and comments on every request, each
+// new entry and comment is copied at write time into the timeline of every
+// friend who may see it, and the index reads its feeds from there.
+//
+// Rows are only references: deletion, hiding, privacy, friendship and blocks
+// are checked again on read, so unfriending or editing never leaves stale
+// items visible.
+
+const (
+	timelineEntry   = 1
+	timelineComment = 2
+
+	// timelineBackfill is how many items of a new friend are copied.
+	timelineBackfill = 100
+)
+
+// fanOutEntry adds a new entry to the timelines of its author's friends.
+func fanOutEntry(q *DB, entryID int) error {
+	_, err := q.Exec(`INSERT IGNORE INTO timeline (user_id, kind, entry_id, comment_id, author_id, created_at)
+SELECT rel.another, ?, e.id, 0, e.user_id, e.created_at
+FROM entries e
+JOIN relations rel ON rel.one = e.user_id
+WHERE e.id = ?`, timelineEntry, entryID)
+	return err
+}
+
+// fanOutComment adds a new comment to the timelines of the commenter's
+// friends who may read the entry.
+func fanOutComment(q *DB, commentID int) error {
+	_, err := q.Exec(`INSERT IGNORE INTO timeline (user_id, kind, entry_id, comment_id, author_id, created_at)
+SELECT rel.another, ?, c.entry_id, c.id, c.user_id, c.created_at
+FROM comments c
+JOIN entries e ON e.id = c.entry_id
+JOIN relations rel ON rel.one = c.user_id
+WHERE c.id = ?
+AND (e.private = 0 OR e.user_id = rel.another OR EXISTS (SELECT 1 FROM relations pr WHERE pr.one = rel.another AND pr.another = e.user_id))`,
+		timelineComment, commentID)
+	return err
+}
+
+// backfillTimeline copies the latest entries and comments of userID's
+// friends into userID's timeline. friendID limits it to a single friend;
+// 0 means all of them.
+func backfillTimeline(q *DB, userID, friendID int) error {
+	cond := "rel.one = ?"
+	args := []interface{}{userID}
+	if friendID != 0 {
+		cond += " AND rel.another = ?"
+		args = append(args, friendID)
+	}
+	_, err := q.Exec(`INSERT IGNORE INTO timeline (user_id, kind, entry_id, comment_id, author_id, created_at)
+SELECT rel.one, ?, e.id, 0, e.user_id, e.created_at
+FROM relations rel
+JOIN entries e ON e.user_id = rel.another
+WHERE `+cond+` AND e.deleted_at IS NULL
+ORDER BY e.created_at DESC
+LIMIT ?`, append(append([]interface{}{timelineEntry}, args...), timelineBackfill)...)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`INSERT IGNORE INTO timeline (user_id, kind, entry_id, comment_id, author_id, created_at)
+SELECT rel.one, ?, c.entry_id, c.id, c.user_id, c.created_at
+FROM relations rel
+JOIN comments c ON c.user_id = rel.another
+JOIN entries e ON e.id = c.entry_id
+WHERE `+cond+` AND c.deleted_at IS NULL AND e.deleted_at IS NULL
+AND (e.private = 0 OR e.user_id = rel.one OR EXISTS (SELECT 1 FROM relations pr WHERE pr.one = rel.one AND pr.another = e.user_id))
+ORDER BY c.created_at DESC
+LIMIT ?`, append(append([]interface{}{timelineComment}, args...), timelineBackfill)...)
+	return err
+}
+
+// dropTimelineBetween removes what the two users wrote from each other's
+// timelines, after they stop being friends.
+func dropTimelineBetween(q *DB, userID, anotherID int) error {
+	_, err := q.Exec(`DELETE FROM timeline WHERE (user_id = ? AND author_id = ?) OR (user_id = ? AND author_id = ?)`, userID, anotherID, anotherID, userID)
+	return err
+}
+
+// loadTimelineEntries returns the latest entries of userID's friends.
+func loadTimelineEntries(q *DB, userID, limit int) ([]Entry, error) {
+	rows, err := q.Query(`SELECT `+entryColumnsE+`
+FROM timeline t
+JOIN entries e ON e.id = t.entry_id
+WHERE t.user_id = ? AND t.kind = ? AND e.deleted_at IS NULL
+AND EXISTS (SELECT 1 FROM relations fr WHERE fr.one = t.user_id AND fr.another = e.user_id)
+ORDER BY t.created_at DESC
+LIMIT ?`, userID, timelineEntry, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]Entry, 0, limit)
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// loadTimelineComments returns the latest comments of userID's friends on
+// entries userID may read.
+func loadTimelineComments(q *DB, userID, limit int) ([]Comment, error) {
+	rows, err := q.Query(`SELECT `+commentColumnsC+`
+FROM timeline t
+JOIN comments c ON c.id = t.comment_id
+JOIN entries e ON e.id = t.entry_id
+WHERE t.user_id = ? AND t.kind = ?
+AND c.deleted_at IS NULL AND c.hidden = 0 AND e.deleted_at IS NULL
+AND EXISTS (SELECT 1 FROM relations fr WHERE fr.one = t.user_id AND fr.another = c.user_id)
+AND (e.private = 0 OR e.user_id = t.user_id OR EXISTS (SELECT 1 FROM relations pr WHERE pr.one = t.user_id AND pr.another = e.user_id))
+AND NOT EXISTS (SELECT 1 FROM blocks b WHERE (b.blocker_id = t.user_id AND b.blocked_id = e.user_id) OR (b.blocker_id = e.user_id AND b.blocked_id = t.user_id))
+ORDER BY t.created_at DESC
+LIMIT ?`, userID, timelineComment, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := make([]Comment, 0, limit)
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// rebuildTimeline refills every user's timeline from scratch, for the
+// initial data and after restoring a dump.
+func rebuildTimeline(q *DB) error {
+	if _, err := q.Exec(`DELETE FROM timeline`); err != nil {
+		return err
+	}
+	rows, err := q.Query(`SELECT id FROM users ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	ids := make([]int, 0, 5000)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if err := backfillTimeline(q, id, 0); err != nil {
+			return err
+		}
+		if (i+1)%1000 == 0 {
+			log.Printf("Rebuilt timelines of %d/%d users.", i+1, len(ids))
+		}
+	}
+	return nil
+}